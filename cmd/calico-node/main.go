@@ -54,6 +54,10 @@ var runShutdown = flagSet.Bool("shutdown", false, "Do shutdown routine.")
 var monitorAddrs = flagSet.Bool("monitor-addresses", false, "Monitor change in node IP addresses")
 var runAllocateTunnelAddrs = flagSet.Bool("allocate-tunnel-addrs", false, "Configure tunnel addresses for this node")
 var allocateTunnelAddrsRunOnce = flagSet.Bool("allocate-tunnel-addrs-run-once", false, "Run allocate-tunnel-addrs in oneshot mode")
+var allocateTunnelAddrsNode = flagSet.String("node", "", "Run allocate-tunnel-addrs for the named node rather than NODENAME")
+var allocateTunnelAddrsYes = flagSet.Bool("yes", false, "Do not prompt for confirmation before allocate-tunnel-addrs modifies another node")
+var allocateTunnelAddrsIPv4Pools = flagSet.String("ipv4-pools", "", "Comma-separated IPv4 pool CIDRs for a one-off allocate-tunnel-addrs run for a --node to assign from, overriding the pools that would normally be chosen")
+var allocateTunnelAddrsOperationTimeout = flagSet.Duration("timeout-per-operation", 0, "Maximum duration of each datastore operation made by allocate-tunnel-addrs, separately from the overall run")
 var monitorToken = flagSet.Bool("monitor-token", false, "Watch for Kubernetes token changes, update CNI config")
 
 // Options for liveness checks.
@@ -157,10 +161,36 @@ func main() {
 		confd.Run(cfg)
 	} else if *runAllocateTunnelAddrs {
 		logrus.SetFormatter(&logutils.Formatter{Component: "tunnel-ip-allocator"})
-		if *allocateTunnelAddrsRunOnce {
-			allocateip.Run(nil)
+		conf := allocateip.LoadConfig()
+		if *allocateTunnelAddrsOperationTimeout < 0 {
+			fmt.Println("--timeout-per-operation must not be negative")
+			os.Exit(1)
+		} else if *allocateTunnelAddrsOperationTimeout != 0 {
+			conf.OperationTimeout = *allocateTunnelAddrsOperationTimeout
+		}
+		if flagSet.NArg() > 0 {
+			// Run a subcommand, e.g. "status". Command-line tools should log to stderr to avoid confusion with the
+			// output.
+			logrus.SetOutput(os.Stderr)
+			os.Exit(allocateip.RunCommand(conf, *allocateTunnelAddrsNode, flagSet.Args()))
+		}
+		if *allocateTunnelAddrsIPv4Pools != "" {
+			// Overriding the pools is only for manual runs, never the usual init container or daemon.
+			if !*allocateTunnelAddrsRunOnce || *allocateTunnelAddrsNode == "" {
+				fmt.Println("--ipv4-pools requires --allocate-tunnel-addrs-run-once and --node")
+				os.Exit(1)
+			}
+			allocateip.RunForNodeWithIPv4Pools(conf, *allocateTunnelAddrsNode, !*allocateTunnelAddrsYes, *allocateTunnelAddrsIPv4Pools)
+			return
+		}
+		var done chan struct{}
+		if !*allocateTunnelAddrsRunOnce {
+			done = make(chan struct{})
+		}
+		if *allocateTunnelAddrsNode != "" {
+			allocateip.RunForNode(conf, *allocateTunnelAddrsNode, !*allocateTunnelAddrsYes, done)
 		} else {
-			allocateip.Run(make(chan struct{}))
+			allocateip.Run(conf, done)
 		}
 	} else if *monitorToken {
 		logrus.SetFormatter(&logutils.Formatter{Component: "cni-config-monitor"})
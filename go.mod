@@ -14,6 +14,7 @@ require (
 	github.com/projectcalico/felix v0.0.0-20211020230000-adb18dd54715
 	github.com/projectcalico/libcalico-go v1.7.2-0.20211020232207-b5bb2d6970f0
 	github.com/projectcalico/typha v0.7.3-0.20211021165318-f2456a43e75c
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.7.0
 	github.com/vishvananda/netlink v1.1.1-0.20210703095558-21f2c55a7727
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
@@ -15,11 +15,19 @@
 package allocateip
 
 import (
+	"bufio"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	gnet "net"
 	"os"
+	"os/signal"
 	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
 	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
@@ -34,7 +42,6 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/options"
 	"github.com/projectcalico/node/buildinfo"
-	"github.com/projectcalico/node/pkg/calicoclient"
 	"github.com/projectcalico/typha/pkg/syncclientutils"
 	"github.com/projectcalico/typha/pkg/syncproto"
 	log "github.com/sirupsen/logrus"
@@ -47,49 +54,191 @@ import (
 // It will assign an address if there are any available, and remove any tunnel addresses
 // that are configured and should no longer be.
 
-// Run runs the tunnel ip allocator. If done is nil, it runs in single-shot mode. If non-nil, it runs in daemon mode
-// performing a reconciliation when IP pool or node configuration changes that may impact the allocations.
-func Run(done <-chan struct{}) {
+const (
+	// releaseRetries is the number of attempts made to release old tunnel addresses before giving up.
+	releaseRetries = 5
+
+	// nodeUpdateAttempts is the number of attempts made to update the node when the update conflicts with another
+	// writer, with a delay of nodeUpdateRetryInterval between them.
+	nodeUpdateAttempts      = 5
+	nodeUpdateRetryInterval = 1 * time.Second
+
+	// releaseInitialBackoff is the delay before the first release retry. The delay doubles on each retry.
+	releaseInitialBackoff = 500 * time.Millisecond
+
+	// nodeReadyRetryInterval is the interval at which the daemon retries assignment while waiting for the node to
+	// become ready.
+	nodeReadyRetryInterval = 10 * time.Second
+
+	// defaultMaxReconcileInterval is the cap on the reconcile interval after repeated failures, if not configured.
+	defaultMaxReconcileInterval = 5 * time.Minute
+
+	// rollbackTimeout is the time allowed to release a newly assigned address when the node update fails.
+	rollbackTimeout = 10 * time.Second
+)
+
+// Run runs the tunnel ip allocator with the configuration loaded by LoadConfig. If done is nil, it runs in single-shot
+// mode. If non-nil, it runs in daemon mode performing a reconciliation when IP pool or node configuration changes that
+// may impact the allocations.
+func Run(conf *Config, done <-chan struct{}) {
+	conf.configureLogging()
+	if err := conf.check(); err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	}
+
 	// This binary is only ever invoked _after_ the
 	// startup binary has been invoked and the modified environments have
 	// been sourced.  Therefore, the NODENAME environment will always be
 	// set at this point.
-	nodename := os.Getenv("NODENAME")
+	nodename := conf.NodeName
 	if nodename == "" {
 		log.Panic("NODENAME environment is not set")
 	}
 
 	// Load the client config from environment.
-	cfg, c := calicoclient.CreateClient()
+	cfg, c := createClient(conf)
+
+	ctx, stop := signalContext()
+	defer stop()
+	run(ctx, nodename, cfg, c, conf, done)
+}
+
+// RunForNode runs the tunnel ip allocator for the named node rather than the node identified by the NODENAME
+// environment. This allows an operator to manage the tunnel addresses of a remote node. If confirm is true and the
+// named node is not this node, the user is prompted to confirm before any changes are made. The configuration and done
+// channel are handled as for Run.
+func RunForNode(conf *Config, nodename string, confirm bool, done <-chan struct{}) {
+	runForNode(conf, nodename, confirm, nil, done)
+}
+
+// RunForNodeWithIPv4Pools runs the tunnel ip allocator once for the named node as for RunForNode, but assigns tunnel
+// addresses from the comma-separated pool CIDRs in ipv4Pools rather than the pools that would normally be chosen,
+// e.g. for debugging. Tunnel addresses outside those pools are reassigned.
+func RunForNodeWithIPv4Pools(conf *Config, nodename string, confirm bool, ipv4Pools string) {
+	pools, err := parseIPv4PoolsOverride(ipv4Pools)
+	if err != nil {
+		conf.configureLogging()
+		log.WithError(err).Fatal("Invalid IPv4 pools")
+	}
+	runForNode(conf, nodename, confirm, pools, nil)
+}
+
+// runForNode runs the tunnel ip allocator for the named node, assigning from the supplied pools if there are any.
+func runForNode(conf *Config, nodename string, confirm bool, ipv4Pools []net.IPNet, done <-chan struct{}) {
+	conf.configureLogging()
+	if err := conf.check(); err != nil {
+		log.WithError(err).Fatal("Invalid configuration")
+	}
+
+	if nodename == "" {
+		log.Panic("Node name is not set")
+	}
+
+	if confirm && nodename != conf.NodeName && !confirmNode(os.Stdin, os.Stdout, nodename) {
+		log.WithField("node", nodename).Info("Not confirmed, exiting without modifying the node")
+		return
+	}
+
+	// Load the client config from environment.
+	conf.IPv4PoolsOverride = ipv4Pools
+	cfg, c := createClient(conf)
+
+	ctx, stop := signalContext()
+	defer stop()
+	run(ctx, nodename, cfg, c, conf, done)
+}
+
+// confirmNode prompts the user to confirm that the tunnel addresses of the named node may be modified, returning true
+// only if the user answers yes.
+func confirmNode(in io.Reader, out io.Writer, nodename string) bool {
+	fmt.Fprintf(out, "Tunnel addresses of node %q may be assigned or released. Continue? [y/N]: ", nodename)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
 
-	run(nodename, cfg, c, done)
+// signalContext returns a context that is cancelled on SIGTERM or SIGINT, so that an in-progress reconciliation can
+// roll back and exit cleanly rather than leaking an address.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
 }
 
-func run(nodename string, cfg *apiconfig.CalicoAPIConfig, c client.Interface, done <-chan struct{}) {
+// run runs the tunnel ip allocator until the context is cancelled, or in daemon mode until done is closed.
+func run(ctx context.Context, nodename string, cfg *apiconfig.CalicoAPIConfig, c client.Interface, conf *Config, done <-chan struct{}) {
+	if err := conf.installLogFieldNames(); err != nil {
+		log.WithError(err).Fatal("Invalid log configuration")
+	}
+
 	// If configured to use host-local IPAM, there is no need to configure tunnel addresses as they use the
 	// first IP of the pod CIDR - this is handled in the k8s backend code in libcalico-go.
 	if cfg.Spec.K8sUsePodCIDR {
 		log.Debug("Using host-local IPAM, no need to allocate a tunnel IP")
 		if done != nil {
 			// If a done channel is specified, only exit when this is closed.
-			<-done
+			select {
+			case <-done:
+			case <-ctx.Done():
+			}
 		}
 		return
 	}
 
+	// Check the pools for misconfigurations that would lead to confusing tunnel address assignment.
+	if err := validatePools(ctx, c, conf); errors.As(err, &ErrMixedEncapPools{}) {
+		log.WithError(err).Fatal("Invalid IP pool configuration")
+	} else if err != nil {
+		log.WithError(err).Warn("Failed to validate IP pools")
+	}
+
 	if done == nil {
 		// Running in single shot mode, so assign addresses and exit.
-		reconcileTunnelAddrs(nodename, cfg, c)
+		if conf.ReassignmentCooldown > 0 {
+			log.WithField("cooldown", conf.ReassignmentCooldown).Warn("The reassignment cooldown only applies in daemon mode, ignoring it")
+		}
+		ctx, warnings := withRunWarnings(ctx)
+		ctx = withReassignmentReasons(ctx)
+		results, err := reconcileLocked(ctx, NewAllocator(c, conf), nodename)
+		if ctx.Err() != nil {
+			log.WithError(err).Info("Reconciliation interrupted, exiting")
+		} else if errors.As(err, &ErrNodeNotReady{}) {
+			log.WithError(err).Info("Tunnel addresses not assigned")
+		} else if errors.As(err, &ErrNodeNotFound{}) {
+			log.WithError(err).Info("Node no longer exists, nothing to do")
+			return
+		} else if err != nil {
+			log.WithError(err).Fatal("Failed to reconcile tunnel addresses")
+		}
+		log.WithFields(summaryFields(ctx, c, conf, nodename, results, warnings.list())).Info("Tunnel address summary")
+		if conf.ChangedExitCode != 0 && anyChanged(results) {
+			os.Exit(conf.ChangedExitCode)
+		}
 		return
 	}
 
-	// This is running as a daemon. Create a long-running reconciler.
+	// This is running as a daemon. Serve metrics if configured.
+	if conf.MetricsAddr != "" || conf.MetricsSocket != "" {
+		l, err := metricsListener(conf)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to listen for metrics requests")
+		}
+		go serveMetrics(l)
+	}
+
+	// Create a long-running reconciler. The reconciles read the pools from a cache, which the reconciler invalidates
+	// when the syncer reports a change.
+	pools := newPoolCache(conf.PoolCacheResync)
 	r := &reconciler{
-		nodename: nodename,
-		cfg:      cfg,
-		client:   c,
-		ch:       make(chan struct{}),
-		data:     make(map[string]interface{}),
+		nodename:  nodename,
+		allocator: NewAllocator(newPoolCacheClient(c, pools), conf),
+		pools:     pools,
+		ch:        make(chan struct{}),
+		data:      make(map[string]interface{}),
 	}
 
 	// Either create a typha syncclient or a local syncer depending on configuration. This calls back into the
@@ -113,33 +262,124 @@ func run(nodename string, cfg *apiconfig.CalicoAPIConfig, c client.Interface, do
 	}
 
 	// Run the reconciler.
-	r.run(done)
+	r.run(ctx, done)
 }
 
 // reconciler watches IPPool and Node configuration and triggers a reconciliation of the Tunnel IP addresses whenever
 // it spots a configuration change that may impact IP selection.
 type reconciler struct {
-	nodename string
-	cfg      *apiconfig.CalicoAPIConfig
-	client   client.Interface
-	ch       chan struct{}
-	data     map[string]interface{}
-	inSync   bool
+	nodename  string
+	allocator *Allocator
+	pools     *poolCache
+	ch        chan struct{}
+	data      map[string]interface{}
+	inSync    bool
 }
 
 // run is the main reconciliation loop, it loops until done.
-func (r reconciler) run(done <-chan struct{}) {
+func (r reconciler) run(ctx context.Context, done <-chan struct{}) {
+	// Cancel the context when done so that an in-progress reconciliation is interrupted.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// If a reconcile interval is configured, reconciliations are also triggered by a timer, which backs off after
+	// consecutive failures.
+	var resync <-chan time.Time
+	var failures int
+	conf := r.allocator.conf
+
 	// Loop forever, updating whenever we get a kick. The first kick will happen as soon as the syncer is in sync.
 	for {
 		select {
 		case <-r.ch:
-			// Received an update that requires reconciliation.  If the reconciliation fails it will cause the daemon
-			// to exit this is fine - it will be restarted, and the syncer will trigger a reconciliation when in-sync
-			// again.
-			reconcileTunnelAddrs(r.nodename, r.cfg, r.client)
+			// Received an update that requires reconciliation.
+		case <-resync:
+			// The reconcile interval has elapsed.
 		case <-done:
 			return
+		case <-ctx.Done():
+			log.Info("Shutting down tunnel address allocator")
+			return
+		}
+
+		// If the reconciliation fails without a reconcile interval configured, the daemon exits. This is fine - it
+		// will be restarted, and the syncer will trigger a reconciliation when in-sync again.
+		_, err := reconcileLocked(ctx, r.allocator, r.nodename)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.WithError(err).Info("Reconciliation interrupted by shutdown")
+				return
+			} else if errors.As(err, &ErrNodeNotReady{}) {
+				// Node readiness is not monitored by the syncer, so poll until the node is ready.
+				log.WithError(err).Infof("Tunnel addresses not assigned, retrying in %s", nodeReadyRetryInterval)
+				go r.kickAfter(ctx, nodeReadyRetryInterval)
+				continue
+			} else if errors.As(err, &ErrNodeNotFound{}) {
+				// The syncer will trigger a reconciliation if the node is recreated.
+				log.WithError(err).Info("Node no longer exists, nothing to do")
+				continue
+			} else if conf.ReconcileInterval == 0 {
+				log.WithError(err).Fatal("Failed to reconcile tunnel addresses")
+			}
+			failures++
+		} else {
+			failures = 0
+			if conf.DetectDuplicateTunnelAddrs {
+				// Only remove our own duplicates, the other nodes will remove theirs. Removing an address updates the
+				// node, which triggers a reconcile to assign a new one.
+				if _, _, err := checkDuplicateTunnelAddrs(ctx, r.allocator.client, conf, conf.ResolveDuplicateTunnelAddrs, r.nodename, sweepLimits{}, ""); err != nil {
+					log.WithError(err).Warn("Failed to check for duplicate tunnel addresses")
+				}
+			}
+		}
+
+		if conf.ReconcileInterval == 0 {
+			continue
+		}
+		interval := nextReconcileInterval(conf.ReconcileInterval, conf.MaxReconcileInterval, failures)
+		if err != nil {
+			log.WithError(err).WithField("failures", failures).Warnf("Failed to reconcile tunnel addresses, retrying in %s", interval)
 		}
+		gaugeReconcileInterval.Set(interval.Seconds())
+		gaugeConsecutiveReconcileFailures.Set(float64(failures))
+		resync = getClock(ctx).After(interval)
+	}
+}
+
+// nextReconcileInterval returns the interval until the next reconciliation. This is the base interval after a
+// success, doubling for each consecutive failure up to the maximum.
+func nextReconcileInterval(base, max time.Duration, failures int) time.Duration {
+	if max == 0 {
+		max = defaultMaxReconcileInterval
+	}
+	if max < base {
+		max = base
+	}
+	d := base
+	for i := 0; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// kickAfter triggers a reconciliation after the supplied delay, unless the context is done first.
+func (r reconciler) kickAfter(ctx context.Context, d time.Duration) {
+	if sleepCtx(ctx, d) != nil {
+		return
+	}
+	select {
+	case r.ch <- struct{}{}:
+	case <-ctx.Done():
 	}
 }
 
@@ -148,6 +388,7 @@ func (r *reconciler) OnStatusUpdated(status bapi.SyncStatus) {
 	if status == bapi.InSync {
 		// We are in-sync, trigger an initial scan/update of the IP addresses.
 		r.inSync = true
+		r.invalidatePools()
 		r.ch <- struct{}{}
 	}
 }
@@ -196,6 +437,9 @@ func (r *reconciler) OnUpdates(updates []bapi.Update) {
 		}
 	}
 
+	if updated {
+		r.invalidatePools()
+	}
 	if updated && r.inSync {
 		// We have updated data. Trigger a reconciliation, but don't block if there is already an update pending.
 		select {
@@ -205,191 +449,443 @@ func (r *reconciler) OnUpdates(updates []bapi.Update) {
 	}
 }
 
-// reconcileTunnelAddrs performs a single shot update of the tunnel IP allocations.
-func reconcileTunnelAddrs(nodename string, cfg *apiconfig.CalicoAPIConfig, c client.Interface) {
-	ctx := context.Background()
+// invalidatePools discards the cached pools, if the reconciler has a pool cache.
+func (r *reconciler) invalidatePools() {
+	if r.pools != nil {
+		r.pools.invalidate()
+	}
+}
+
+// reconcileTunnelAddrs performs a single shot update of the tunnel IP allocations, returning the result for each
+// managed tunnel address type.
+func reconcileTunnelAddrs(ctx context.Context, nodename string, c client.Interface, conf *Config) (map[string]TunnelAddrResult, error) {
+	// Tag the context with a run ID so that the logs for each reconcile can be correlated, and bound the time spent
+	// retrying across all of the tunnel types.
+	ctx = withRetryBudget(withRunID(ctx, newRunID()), conf.RetryBudget)
+	getLogger(ctx, "").WithField("node", nodename).Debug("Reconciling tunnel addresses")
+
 	// Get node resource for given nodename.
 	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
 	if err != nil {
-		log.WithError(err).Fatalf("failed to fetch node resource '%s'", nodename)
+		return nil, nodeOperationError("get", nodename, err)
 	}
 
 	// Get list of ip pools
-	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	ipPoolList, pools, err := listTunnelPools(ctx, c, conf, node)
 	if err != nil {
-		log.WithError(err).Fatal("Unable to query IP pool configuration")
+		return nil, err
+	}
+	if len(ipPoolList.Items) == 0 {
+		// Distinguish a cluster that is still being bootstrapped from one with no suitable pools, since in both
+		// cases any existing tunnel addresses are silently removed below.
+		getLogger(ctx, "").Info("No IP pools are configured yet, no tunnel addresses will be assigned")
+	} else if isIPv6Only(*ipPoolList) {
+		// The node spec has no fields for IPv6 tunnel addresses, so there is nothing to assign. Any IPv4 tunnel
+		// addresses left over are still removed below.
+		getLogger(ctx, "").Info("Only IPv6 pools are enabled, IPv6 tunnel addresses are not supported so none will be assigned")
+	} else if len(pools) == 0 {
+		getLogger(ctx, "").Info("IP pools exist but none are enabled for tunnel addresses on this node, no tunnel addresses will be assigned")
 	}
 
-	// If wireguard is enabled then allocate an IP for the wireguard device. We do this for all deployment types even
-	// when pod CIDRs are not managed by Calico.
-	if cidrs := determineEnabledPoolCIDRs(*node, *ipPoolList, ipam.AttributeTypeWireguard); len(cidrs) > 0 {
-		ensureHostTunnelAddress(ctx, c, nodename, cidrs, ipam.AttributeTypeWireguard)
-	} else {
-		removeHostTunnelAddr(ctx, c, nodename, ipam.AttributeTypeWireguard)
+	// If configured, hold off assigning tunnel addresses until the node is ready. Unwanted addresses are still removed.
+	ready := true
+	if conf.RequireNodeReady {
+		if ready, err = isNodeReadyForAssignment(ctx, c, nodename); err != nil {
+			return nil, err
+		} else if !ready {
+			getLogger(ctx, "").WithField("node", nodename).Info("Node is not ready, skipping tunnel address assignment")
+		}
 	}
 
-	// Query the IPIP enabled pools and either configure the tunnel
-	// address, or remove it.
-	if cidrs := determineEnabledPoolCIDRs(*node, *ipPoolList, ipam.AttributeTypeIPIP); len(cidrs) > 0 {
-		ensureHostTunnelAddress(ctx, c, nodename, cidrs, ipam.AttributeTypeIPIP)
-	} else {
-		removeHostTunnelAddr(ctx, c, nodename, ipam.AttributeTypeIPIP)
+	// If wireguard is enabled then allocate an IP for the wireguard device. We do this for all deployment types even
+	// when pod CIDRs are not managed by Calico. IPIP and VXLAN addresses are allocated if there are enabled pools of
+	// that type.
+	//
+	// Remove the tunnel addresses that are no longer required before assigning any new ones. When a pool switches
+	// encapsulation, e.g. from IPIP to VXLAN, this ensures the node never has both addresses set. If a removal fails
+	// we return before assigning anything.
+	//
+	// Types that are not managed by us are skipped entirely, leaving the node as it is. IPIP is likewise skipped on
+	// Windows nodes, which only support VXLAN, so that no address is wasted on a field that is never used.
+	states := desiredTunnelState(node, pools, conf)
+	for _, attrType := range reconcileOrder {
+		if state := states[attrType]; state.Action == tunnelActionSkip {
+			getLogger(ctx, attrType).WithField("node", nodename).Infof("Leaving the tunnel address unchanged, %s", state.Reason)
+		}
+	}
+	attrTypes := plannedTypes(states)
+	for _, attrType := range attrTypes {
+		if state := states[attrType]; state.Action == tunnelActionRemove {
+			if state.Addr != "" {
+				getLogger(ctx, attrType).WithFields(log.Fields{"node": nodename, "IP": state.Addr}).Infof("Removing the tunnel address, %s", state.Reason)
+			}
+			if err := removeHostTunnelAddr(ctx, c, conf, nodename, attrType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if ready {
+		for _, attrType := range attrTypes {
+			if state := states[attrType]; state.Action == tunnelActionKeep || state.Action == tunnelActionAssign {
+				getLogger(ctx, attrType).WithField("reason", state.Reason).Debugf("%s tunnel address", state.Action)
+				err := ensureHostTunnelAddress(ctx, c, conf, node, state, attrType)
+				if conf.OptionalTunnelAddrs && errors.As(err, &ErrPoolExhausted{}) {
+					getLogger(ctx, attrType).WithError(err).Warn("No tunnel address available, continuing without one since tunnel addresses are optional")
+					addRunWarning(ctx, "%s: no tunnel address available", attrType)
+				} else if err != nil {
+					return nil, err
+				}
+			}
+		}
 	}
 
-	// Query the VXLAN enabled pools and either configure the tunnel
-	// address, or remove it.
-	if cidrs := determineEnabledPoolCIDRs(*node, *ipPoolList, ipam.AttributeTypeVXLAN); len(cidrs) > 0 {
-		ensureHostTunnelAddress(ctx, c, nodename, cidrs, ipam.AttributeTypeVXLAN)
-	} else {
-		removeHostTunnelAddr(ctx, c, nodename, ipam.AttributeTypeVXLAN)
+	results, err := getTunnelAddrResults(ctx, c, conf, node, attrTypes)
+	if err != nil {
+		return nil, err
 	}
+	checkHandleAddrCounts(ctx, c, conf, nodename, states)
+	if !ready {
+		return results, ErrNodeNotReady{Node: nodename}
+	}
+
+	gaugeLastSuccessfulReconcile.WithLabelValues(nodename).SetToCurrentTime()
+	return results, nil
 }
 
-func ensureHostTunnelAddress(ctx context.Context, c client.Interface, nodename string, cidrs []net.IPNet, attrType string) {
-	logCtx := getLogger(attrType)
+// ensureHostTunnelAddress carries out the desired state of the node's tunnel address of the specified type, as planned
+// by desiredTunnelState from the node. The decisions are all made by the planner: where the plan depends on the IPAM
+// allocation of the current address, the allocation is read and the plan refined by desiredStateOfAllocation, and after
+// the address has been rewritten or its allocation repaired, the plan is refined again.
+func ensureHostTunnelAddress(ctx context.Context, c client.Interface, conf *Config, node *libapi.Node, state desiredState, attrType string) error {
+	nodename := node.Name
+	logCtx := getLogger(ctx, attrType)
 	logCtx.WithField("Node", nodename).Debug("Ensure tunnel address is set")
 
-	// Get the currently configured address.
-	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
-	if err != nil {
-		logCtx.WithError(err).Fatalf("Unable to retrieve tunnel address. Error getting node '%s'", nodename)
-	}
-
-	// Get the address and ipam attribute string
-	var addr string
-	switch attrType {
-	case ipam.AttributeTypeVXLAN:
-		addr = node.Spec.IPv4VXLANTunnelAddr
-	case ipam.AttributeTypeIPIP:
-		if node.Spec.BGP != nil {
-			addr = node.Spec.BGP.IPv4IPIPTunnelAddr
+	repaired := false
+	for {
+		if state.Err != nil {
+			return state.Err
 		}
-	case ipam.AttributeTypeWireguard:
-		if node.Spec.Wireguard != nil {
-			addr = node.Spec.Wireguard.InterfaceIPv4Address
+		switch state.Action {
+		case tunnelActionSkip:
+			return nil
+		case tunnelActionRemove:
+			return removeHostTunnelAddr(ctx, c, conf, nodename, attrType)
+		case tunnelActionVerify:
+			return verifyUserManagedTunnelAddr(ctx, c, state.Addr, state.Pools, logCtx)
+		case tunnelActionPreserve:
+			return preserveForeignTunnelAddr(ctx, state.Addr, attrType, logCtx)
 		}
-	}
 
-	// Work out if we need to assign a tunnel address.
-	// In most cases we should not release current address and should assign new one.
-	release := false
-	assign := true
-	if addr == "" {
-		// The tunnel has no IP address assigned, assign one.
-		logCtx.Info("Assign a new tunnel address")
+		if state.Rewrite {
+			logCtx.WithField("IP", state.Addr).Warn("Current address has a CIDR suffix, rewriting it as a bare IP")
+			err := updateNodeWithAddress(ctx, c, conf, nodename, state.Addr, state.Pools, attrType, AuditReasonNormalized)
+			if errors.Is(err, errTunnelAddrSetConcurrently) {
+				// Another writer set an address in the meantime, so plan again from the node as it is now.
+				if node, err = c.Nodes().Get(ctx, nodename, options.GetOptions{}); err != nil {
+					return nodeOperationError("get", nodename, err)
+				}
+				state = desiredTunnelState(node, poolIndex{attrType: state.Pools}, conf)[attrType]
+				continue
+			} else if err != nil {
+				return err
+			}
+			state.Rewrite = false
+		}
 
-		// Defensively release any IP addresses with this handle. This covers a theoretical case
-		// where the node object has lost its reference to its IP, but the allocation still exists
-		// in IPAM. For example, if the node object was manually edited.
-		release = true
-	} else {
-		// Go ahead checking status of current address.
-		ipAddr := gnet.ParseIP(addr)
-		if ipAddr == nil {
-			logCtx.WithError(err).Fatalf("Failed to parse the CIDR '%s'", addr)
+		if state.CheckAllocation {
+			alloc, err := getTunnelAllocation(ctx, c, state.Addr)
+			if err != nil {
+				return err
+			}
+			state = desiredStateOfAllocation(node, state, alloc, conf, attrType)
+			continue
 		}
 
-		// Check if we got correct assignment attributes.
-		attr, handle, err := c.IPAM().GetAssignmentAttributes(ctx, net.IP{IP: ipAddr})
-		if err == nil {
-			if attr[ipam.AttributeType] == attrType && attr[ipam.AttributeNode] == nodename {
-				// The tunnel address is still assigned to this node, but is it in the correct pool this time?
-				if !isIpInPool(addr, cidrs) {
-					// Wrong pool, release this address.
-					logCtx.WithField("currentAddr", addr).Info("Current address is not in a valid pool, release it and reassign")
-					release = true
-				} else {
-					// Correct pool, keep this address.
-					logCtx.WithField("currentAddr", addr).Info("Current address is still valid, do nothing")
-					assign = false
-				}
-			} else if len(attr) == 0 {
-				// No attributes means that this is an old address, assigned by code that didn't use
-				// allocation attributes. It might be a pod address, or it might be a node tunnel
-				// address. The only way to tell is by the existence of a handle, since workload
-				// addresses have always used a handle, whereas tunnel addresses didn't start
-				// using handles until the same time as they got allocation attributes.
-				if handle != nil {
-					// Handle exists, so this address belongs to a workload. We need to assign
-					// a new one for the node, but we shouldn't clean up the old address.
-					logCtx.WithField("currentAddr", addr).Info("Current address is occupied, assign a new one")
-				} else {
-					// Handle does not exist. This is just an old tunnel address that comes from
-					// a time before we used handles and allocation attributes. Attempt to
-					// reassign the same address, but now with metadata. It's possible that someone
-					// else takes the address while we do this, in which case we'll just
-					// need to assign a new address.
-					if err := correctAllocationWithHandle(ctx, c, addr, nodename, attrType); err != nil {
-						if _, ok := err.(cerrors.ErrorResourceAlreadyExists); !ok {
-							// Unknown error attempting to allocate the address. Exit.
-							logCtx.WithError(err).Fatal("Error correcting tunnel IP allocation")
-						}
-
-						// The address was taken by someone else. We need to assign a new one.
-						logCtx.WithError(err).Warn("Failed to correct missing attributes, will assign a new address")
-					} else {
-						// We corrected the address, we can just return.
-						logCtx.Info("Updated tunnel address with allocation attributes")
-						return
-					}
-				}
+		logCtx := logCtx.WithField("currentAddr", state.Addr)
+		switch state.Action {
+		case tunnelActionKeep:
+			if state.Warning != "" {
+				logCtx.Warnf("Keeping the current address, %s", state.Reason)
+				addRunWarning(ctx, "%s: %s", attrType, state.Warning)
 			} else {
-				// The allocation has attributes, but doesn't belong to us. Assign a new one.
-				logCtx.WithField("currentAddr", addr).Info("Current address is occupied, assign a new one")
+				logCtx.Infof("Keeping the current address, %s", state.Reason)
 			}
-		} else if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
-			// The tunnel address is not assigned, reassign it.
-			logCtx.WithField("currentAddr", addr).Info("Current address is not assigned, assign a new one")
+			if state.CheckHandleAddrs {
+				return checkExtraHandleAddrs(ctx, c, conf, nodename, state.Addr, attrType, logCtx)
+			}
+			return nil
+		case tunnelActionRepair:
+			if repaired {
+				return fmt.Errorf("tunnel IP allocation of '%s' still needs repairing after it was repaired: %s", state.Addr, state.Reason)
+			}
+			logCtx.Warnf("Repairing the allocation of the current address, %s", state.Reason)
+			err := correctAllocationWithHandle(ctx, c, conf, state.Addr, nodename, attrType)
+			if _, ok := err.(cerrors.ErrorResourceAlreadyExists); err != nil && !ok {
+				return fmt.Errorf("error repairing tunnel IP allocation: %w", err)
+			} else if err != nil {
+				// The address was taken by someone else. We need to assign a new one.
+				logCtx.WithError(err).Warn("Failed to repair the allocation, will assign a new address")
+				state = desiredState{Action: tunnelActionAssign, Addr: state.Addr, Pools: state.Pools, Reason: "tunnel address was taken while repairing its allocation"}
+				continue
+			}
+			// Once repaired, the allocation is checked as normal.
+			logCtx.Info("Repaired the tunnel address allocation")
+			repaired = true
+			state = desiredState{Action: tunnelActionKeep, Addr: state.Addr, Pools: state.Pools, CheckAllocation: true}
+			continue
+		}
+		return assignPlannedTunnelAddr(ctx, c, conf, nodename, state, attrType, logCtx)
+	}
+}
 
-			// Defensively release any IP addresses with this handle. This covers a theoretical case
-			// where the node object has lost its reference to its correct IP, but the allocation still exists
-			// in IPAM. For example, if the node object was manually edited.
-			release = true
-		} else {
-			// Failed to get assignment attributes, datastore connection issues possible, panic
-			logCtx.WithError(err).Panicf("Failed to get assignment attributes for CIDR '%s'", addr)
+// getTunnelAllocation returns the IPAM allocation of the tunnel address.
+func getTunnelAllocation(ctx context.Context, c client.Interface, addr string) (tunnelAllocation, error) {
+	attrs, handle, err := c.IPAM().GetAssignmentAttributes(ctx, net.IP{IP: gnet.ParseIP(addr)})
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+		return tunnelAllocation{}, nil
+	} else if err != nil {
+		// Failed to get assignment attributes, datastore connection issues possible.
+		return tunnelAllocation{}, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get assignment attributes for '%s'", addr), Err: err}
+	}
+	return tunnelAllocation{Exists: true, Attrs: attrs, Handle: handle}, nil
+}
+
+// assignPlannedTunnelAddr assigns a new tunnel address from the planned pools, releasing the addresses held by our
+// handle if planned. The reassignment of an address of ours is deferred while it is within its cooldown, or if the
+// reassignment limits have been reached, since the pool configuration may be oscillating.
+func assignPlannedTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename string, state desiredState, attrType string, logCtx *log.Entry) error {
+	addr, cidrs := state.Addr, state.Pools
+	if state.Reassign {
+		if remaining := reassignmentCooldown(ctx, nodename, attrType, getClock(ctx).Now()); remaining > 0 {
+			// This address was only just assigned to replace another. Give the pool configuration time to settle
+			// rather than flapping between addresses.
+			logCtx.WithField("remaining", remaining).Infof("Deferring reassignment within cooldown, %s", state.Reason)
+			addRunWarning(ctx, "%s: reassignment of address %s deferred for %s cooldown", attrType, addr, remaining)
+			counterSuppressedReassignments.WithLabelValues(attrType).Inc()
+			return nil
+		}
+		if !allowReassignment(ctx, getClock(ctx).Now()) {
+			// We have already reassigned as many addresses as we are allowed to recently, so keep the existing
+			// address for now.
+			logCtx.Warnf("Reassignment suppressed due to flapping, %s", state.Reason)
+			addRunWarning(ctx, "%s: reassignment of address %s suppressed due to flapping", attrType, addr)
+			counterSuppressedReassignments.WithLabelValues(attrType).Inc()
+			return nil
+		}
+		reason := getReassignmentReason(ctx, c, addr, attrType)
+		logCtx.WithField("reason", reason).Infof("Reassigning the tunnel address, %s", state.Reason)
+		addReassignmentReason(ctx, attrType, reason)
+	} else {
+		logCtx.Infof("Assigning a new tunnel address, %s", state.Reason)
+	}
+
+	// A reassignment only counts against the reassignment limits once it has succeeded, so that a failed attempt does
+	// not use up a slot.
+	assigned := func(err error) error {
+		if err == nil && state.Reassign {
+			recordReassignment(ctx, nodename, attrType, getClock(ctx).Now())
 		}
+		return err
 	}
 
-	if release {
+	if state.Release {
+		// If a previous run was interrupted after assigning an address but before setting it on the node, our handle
+		// already holds a valid address. Reuse it rather than releasing it and assigning a new one.
+		if reused, err := reuseHandleAddr(ctx, c, conf, nodename, cidrs, attrType, logCtx); err != nil {
+			return err
+		} else if reused {
+			return assigned(nil)
+		}
+
+		if conf.ReassignmentOrder != ReassignmentOrderBreakBeforeMake {
+			logCtx.WithField("IP", addr).Info("Assign new tunnel address before releasing any old tunnel addresses")
+			return assigned(replaceHostTunnelAddr(ctx, c, conf, nodename, cidrs, attrType))
+		}
+
 		logCtx.WithField("IP", addr).Info("Release any old tunnel addresses")
 		handle, _ := generateHandleAndAttributes(nodename, attrType)
-		if err := c.IPAM().ReleaseByHandle(ctx, handle); err != nil {
-			if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
-				logCtx.WithError(err).Fatal("Failed to release old addresses")
+		if err := releaseByHandleWithRetry(ctx, c, handle, logCtx); err != nil {
+			// We could not release the old addresses. Don't assign a new address, otherwise this node would hold
+			// two tunnel addresses - leave the current address in place and let the next reconcile retry.
+			logCtx.WithError(err).WithField("IP", addr).Warn("Failed to release old addresses, leaving current tunnel address in place")
+			addRunWarning(ctx, "%s: failed to release old addresses: %v", attrType, err)
+			return nil
+		}
+	}
+
+	logCtx.WithField("IP", addr).Info("Assign new tunnel address")
+	return assigned(assignHostTunnelAddr(ctx, c, conf, nodename, cidrs, attrType))
+}
+
+// checkExtraHandleAddrs checks that our handle holds no addresses other than the node's current tunnel address, addr.
+// Extra addresses may be left behind by an interrupted reassignment, and would otherwise be leaked. By default they are
+// released, but if so configured ErrExtraHandleAddrs is returned instead so that they can be investigated.
+func checkExtraHandleAddrs(ctx context.Context, c client.Interface, conf *Config, nodename, addr, attrType string, logCtx *log.Entry) error {
+	handle, _ := generateHandleAndAttributes(nodename, attrType)
+	ips, err := c.IPAM().IPsByHandle(ctx, handle)
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+		return nil
+	} else if err != nil {
+		return ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+	}
+	var extras []net.IP
+	for _, ip := range ips {
+		if !ip.Equal(parseTunnelIP(addr).IP) {
+			extras = append(extras, ip)
+		}
+	}
+	if len(extras) == 0 {
+		return nil
+	}
+
+	logCtx = logCtx.WithFields(log.Fields{"handle": handle, "currentAddr": addr, "extraIPs": extras})
+	if conf.ExtraHandleAddrs == ExtraHandleAddrsFail {
+		logCtx.Error("Handle holds tunnel addresses that are not set on the node, leaving them for manual intervention")
+		return ErrExtraHandleAddrs{Handle: handle, Addr: addr, Extras: extras}
+	}
+	logCtx.Warn("Handle holds tunnel addresses that are not set on the node, releasing them")
+	if err := releaseIPs(ctx, c, extras, logCtx); err != nil {
+		return err
+	}
+	addRunWarning(ctx, "%s: released addresses %v held by handle %s but not set on the node", attrType, extras, handle)
+	return nil
+}
+
+// preserveForeignTunnelAddr leaves in place a tunnel address that is outside the enabled pools and not allocated with
+// our handle, on the assumption that it was set manually to an external address. It is not ours to release, so the
+// best we can do is warn that the node is not using an address from IPAM.
+func preserveForeignTunnelAddr(ctx context.Context, addr, attrType string, logCtx *log.Entry) error {
+	logCtx.WithField("currentAddr", addr).Warn("Current address is outside the enabled pools and not allocated to this node, " +
+		"leaving it in place as it appears to be set manually. Remove it from the node to have an address assigned from IPAM")
+	addRunWarning(ctx, "%s: leaving manually set address %s in place", attrType, addr)
+	return nil
+}
+
+// reuseHandleAddr sets the address held by our handle on the node, if the handle holds exactly one address and it is
+// within one of the supplied pools. This adopts an address reserved by the reserve command before the node existed, as
+// well as one left by an interrupted run. It returns whether the address was reused.
+func reuseHandleAddr(ctx context.Context, c client.Interface, conf *Config, nodename string, cidrs []net.IPNet, attrType string, logCtx *log.Entry) (bool, error) {
+	handle, _ := generateHandleAndAttributes(nodename, attrType)
+	ips, err := c.IPAM().IPsByHandle(ctx, handle)
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+		return false, nil
+	} else if err != nil {
+		return false, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+	}
+	if len(ips) != 1 || !isIpInPool(ips[0].String(), cidrs) {
+		return false, nil
+	}
+
+	ip := ips[0].String()
+	logCtx.WithFields(log.Fields{"IP": ip, "handle": handle}).Info("Reusing tunnel address already allocated with our handle")
+	if err := updateNodeWithAddress(ctx, c, conf, nodename, ip, cidrs, attrType, AuditReasonReused); errors.Is(err, errTunnelAddrSetConcurrently) {
+		logCtx.WithField("IP", ip).Info("Tunnel address was set concurrently, releasing the address we would have reused")
+		releaseAssignedAddr(c, ips[0].IP, logCtx.WithField("IP", ip))
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// verifyUserManagedTunnelAddr checks that a user-managed tunnel address is allocated in IPAM and within one of the
+// supplied pools. An invalid address is logged as an error but left in place for the user to correct.
+func verifyUserManagedTunnelAddr(ctx context.Context, c client.Interface, addr string, cidrs []net.IPNet, logCtx *log.Entry) error {
+	logCtx = logCtx.WithField("currentAddr", addr)
+	invalid := func(reason string) error {
+		logCtx.Errorf("User-managed tunnel address %s", reason)
+		addRunWarning(ctx, "user-managed tunnel address %q %s", addr, reason)
+		return nil
+	}
+	if addr == "" {
+		return invalid("is not set, not assigning one")
+	}
+	ipAddr := gnet.ParseIP(addr)
+	if ipAddr == nil {
+		return invalid("is not a valid IP address")
+	}
+	if _, _, err := c.IPAM().GetAssignmentAttributes(ctx, net.IP{IP: ipAddr}); err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return ErrDatastoreUnavailable{Operation: fmt.Sprintf("get assignment attributes for '%s'", addr), Err: err}
+		}
+		return invalid("is not allocated in IPAM")
+	}
+	if !isIpInPool(addr, cidrs) {
+		return invalid("is not in a valid pool")
+	}
+	logCtx.Debug("User-managed tunnel address is valid")
+	return nil
+}
+
+// releaseByHandleWithRetry releases all addresses allocated with the supplied handle. Release failures are often
+// transient, so the release is retried with an exponential backoff before giving up and returning the last error.
+// A handle with no allocations is not treated as an error.
+func releaseByHandleWithRetry(ctx context.Context, c client.Interface, handle string, logCtx *log.Entry) error {
+	backoff := releaseInitialBackoff
+	start := getClock(ctx).Now()
+	var err error
+	for i := 0; i < releaseRetries; i++ {
+		if i > 0 {
+			logCtx.WithError(err).WithField("handle", handle).WithFields(retryFields(ctx, i, releaseRetries, start)).Infof("Error releasing addresses, retrying in %s", backoff)
+			if err := retrySleep(ctx, backoff, err); err != nil {
+				return err
 			}
+			backoff *= 2
+		}
+
+		err = c.IPAM().ReleaseByHandle(ctx, handle)
+		if err == nil {
+			return nil
+		} else if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
 			// No existing allocations for this node.
+			return nil
 		}
 	}
+	return err
+}
 
-	if assign {
-		logCtx.WithField("IP", addr).Info("Assign new tunnel address")
-		assignHostTunnelAddr(ctx, c, nodename, cidrs, attrType)
+// releaseIPs releases the supplied addresses. Addresses that are already unallocated, e.g. because a previous attempt
+// released them before failing to update the node, are treated as released so that removal is safe to retry.
+func releaseIPs(ctx context.Context, c client.Interface, ips []net.IP, logCtx *log.Entry) error {
+	unallocated, err := c.IPAM().ReleaseIPs(ctx, ips)
+	if isPoolNotFound(err) {
+		logCtx.WithError(err).WithField("IPs", ips).Info("The pool of the addresses no longer exists, nothing to release")
+		return nil
+	} else if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			return ErrDatastoreUnavailable{Operation: fmt.Sprintf("release addresses %v", ips), Err: err}
+		}
+		logCtx.WithField("IPs", ips).Info("Addresses already released")
+		return nil
 	}
+	if len(unallocated) > 0 {
+		logCtx.WithField("IPs", unallocated).Info("Addresses already released")
+	}
+	return nil
 }
 
-func correctAllocationWithHandle(ctx context.Context, c client.Interface, addr, nodename string, attrType string) error {
+func correctAllocationWithHandle(ctx context.Context, c client.Interface, conf *Config, addr, nodename string, attrType string) error {
 	ipAddr := net.ParseIP(addr)
 	if ipAddr == nil {
-		log.Fatalf("Failed to parse node tunnel address '%s'", addr)
-		return nil
+		return ErrInvalidTunnelAddress{Addr: addr, Err: errors.New("failed to parse IP address")}
 	}
 
 	// Release the old allocation.
 	ipsToRelease := []net.IP{*ipAddr}
 	_, err := c.IPAM().ReleaseIPs(ctx, ipsToRelease)
 	if err != nil {
-		// If we fail to release the old allocation, we shouldn't continue any further. Just exit.
-		log.WithField("IP", ipAddr.String()).WithError(err).Fatal("Error releasing address")
+		// If we fail to release the old allocation, we shouldn't continue any further.
+		return ErrDatastoreUnavailable{Operation: fmt.Sprintf("release address '%s'", addr), Err: err}
 	}
 
 	// Attempt to re-assign the same address, but with a handle this time.
 	handle, attrs := generateHandleAndAttributes(nodename, attrType)
+	conf.addClusterAttribute(attrs)
 	args := ipam.AssignIPArgs{
 		IP:       *ipAddr,
 		HandleID: &handle,
 		Attrs:    attrs,
-		Hostname: nodename,
+		Hostname: conf.ipamHostname(nodename),
 	}
 
 	// If we fail to allocate the same IP, return an error. We'll just
@@ -412,143 +908,391 @@ func generateHandleAndAttributes(nodename string, attrType string) (string, map[
 	return handle, attrs
 }
 
+// IsTunnelAddress returns whether the IPAM allocation attributes are those of a node tunnel address, as opposed to a
+// workload or other address.
+func IsTunnelAddress(attrs map[string]string) bool {
+	return checkTunnelAttrType(attrs[ipam.AttributeType]) == nil
+}
+
 // assignHostTunnelAddr claims an IP address from the first pool
 // with some space. Stores the result in the host's config as its tunnel
 // address. It will assign a VXLAN address if vxlan is true, otherwise an IPIP address.
-func assignHostTunnelAddr(ctx context.Context, c client.Interface, nodename string, cidrs []net.IPNet, attrType string) {
+func assignHostTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename string, cidrs []net.IPNet, attrType string) error {
+	handle, _ := generateHandleAndAttributes(nodename, attrType)
+	_, err := assignHostTunnelAddrWithRollback(ctx, c, conf, nodename, cidrs, attrType, func(logCtx *log.Entry) {
+		rollbackAssignment(c, handle, logCtx)
+	})
+	return err
+}
+
+// replaceHostTunnelAddr assigns a new tunnel address and sets it on the node before releasing the addresses previously
+// held by our handle, so that the node is never left without a tunnel address. If the assignment fails, only the
+// newly assigned address is released, since the old address is still set on the node. A failure to release the old
+// addresses is logged but not returned, since the node already has its new address.
+func replaceHostTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename string, cidrs []net.IPNet, attrType string) error {
+	handle, _ := generateHandleAndAttributes(nodename, attrType)
+	logCtx := getLogger(ctx, attrType).WithField("handle", handle)
+	old, err := c.IPAM().IPsByHandle(ctx, handle)
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+		old = nil
+	} else if err != nil {
+		return ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+	}
+
+	ip, err := assignHostTunnelAddrWithRollback(ctx, c, conf, nodename, cidrs, attrType, func(logCtx *log.Entry) {
+		releaseHandleAddrsExcept(c, handle, old, logCtx)
+	})
+	if err != nil || ip == "" {
+		// Either the assignment failed, or another writer set an address concurrently that may be one of the old
+		// addresses.
+		return err
+	}
+
+	// The assignment may have adopted one of the old addresses, which must not be released.
+	var release []net.IP
+	for _, o := range old {
+		if o.String() != ip {
+			release = append(release, o)
+		}
+	}
+	if old = release; len(old) == 0 {
+		return nil
+	}
+
+	logCtx.WithFields(log.Fields{"IP": ip, "oldIPs": old}).Info("Release old tunnel addresses")
+	if err := releaseIPs(ctx, c, old, logCtx); err != nil {
+		logCtx.WithError(err).WithField("oldIPs", old).Warn("Failed to release old tunnel addresses after assigning a new one")
+		addRunWarning(ctx, "%s: failed to release old addresses %v: %v", attrType, old, err)
+	}
+	return nil
+}
+
+// assignHostTunnelAddrWithRollback assigns a tunnel address and sets it on the node, calling rollback to release the
+// assignment if it cannot be completed. It returns the assigned address, or an empty string if another writer set a
+// valid address on the node concurrently, in which case the address we assigned has already been released.
+func assignHostTunnelAddrWithRollback(ctx context.Context, c client.Interface, conf *Config, nodename string, cidrs []net.IPNet, attrType string, rollback func(logCtx *log.Entry)) (string, error) {
 	// Build attributes and handle for this allocation.
 	handle, attrs := generateHandleAndAttributes(nodename, attrType)
-	logCtx := getLogger(attrType)
+	conf.addClusterAttribute(attrs)
+	logCtx := getLogger(ctx, attrType)
 
 	args := ipam.AutoAssignArgs{
 		Num4:        1,
 		Num6:        0,
 		HandleID:    &handle,
 		Attrs:       attrs,
-		Hostname:    nodename,
-		IPv4Pools:   cidrs,
+		Hostname:    conf.ipamHostname(nodename),
 		IntendedUse: api.IPPoolAllowedUseTunnel,
 	}
 
-	v4Assignments, _, err := c.IPAM().AutoAssign(ctx, args)
+	v4Assignments, source, err := assignTunnelAddr(ctx, c, conf, nodename, cidrs, attrType, args, logCtx)
 	if err != nil {
-		logCtx.WithError(err).Fatal("Unable to autoassign an address")
+		if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+			// We were interrupted, or the assignment timed out, so it may have completed in the datastore even
+			// though we got an error. Release anything assigned with our handle so that it is not leaked.
+			logCtx.WithError(err).Info("Interrupted during tunnel address assignment, rolling back")
+			rollback(logCtx)
+		}
+		return "", err
+	}
+	logCtx = logCtx.WithField("source", source)
+
+	// Check that we were granted the number of addresses we requested. If only some were granted, release them.
+	if err := checkAssignments(v4Assignments, args.Num4); err != nil {
+		if len(v4Assignments.IPs) > 0 {
+			logCtx.WithError(err).Error("Fewer addresses assigned than requested, releasing them")
+			rollback(logCtx)
+			return "", err
+		}
+		if allAddressesReserved(ctx, c, cidrs, logCtx) {
+			return "", ErrAddressesReserved{Pools: cidrs, Err: err}
+		}
+		return "", checkStrictAffinity(ctx, c, nodename, err, logCtx)
 	}
 
-	if err := v4Assignments.PartialFulfillmentError(); err != nil {
-		logCtx.WithError(err).Fatal("Unable to autoassign an address")
+	// Check that IPAM assigned an IPv4 address and honored the requested pools before programming the address. If
+	// not, release it.
+	ip := v4Assignments.IPs[0].IP.String()
+	if v4Assignments.IPs[0].IP.To4() == nil {
+		logCtx.WithField("IP", ip).Error("Assigned address is not an IPv4 address, releasing it")
+		rollback(logCtx.WithField("IP", ip))
+		return "", ErrAddressFamilyMismatch{Addr: ip, Requested: 4}
+	}
+	if !isIpInPool(ip, cidrs) {
+		logCtx.WithField("IP", ip).Error("Assigned address is not within the requested pools, releasing it")
+		rollback(logCtx.WithField("IP", ip))
+		return "", ErrAddressNotInPool{Addr: ip, Pools: cidrs}
 	}
 
 	// Update the node object with the assigned address.
-	ip := v4Assignments.IPs[0].IP.String()
-	if err = updateNodeWithAddress(ctx, c, nodename, ip, attrType); err != nil {
-		// We hit an error, so release the IP address before exiting.
-		err := c.IPAM().ReleaseByHandle(ctx, handle)
-		if err != nil {
-			logCtx.WithError(err).WithField("IP", ip).Errorf("Error releasing IP address on failure")
+	reason := AuditReasonAssigned
+	if source == assignmentSourceHandle {
+		reason = AuditReasonReused
+	}
+	if err = updateNodeWithAddress(ctx, c, conf, nodename, ip, cidrs, attrType, reason); errors.Is(err, errTunnelAddrSetConcurrently) {
+		// Another allocator set a valid address while we were retrying. Release only the address we assigned, since
+		// the other address may share our handle.
+		logCtx.WithField("IP", ip).Info("Tunnel address was set concurrently, releasing the address we assigned")
+		releaseAssignedAddr(c, v4Assignments.IPs[0].IP, logCtx.WithField("IP", ip))
+		return "", nil
+	} else if err != nil {
+		// We hit an error, so release the IP address before returning.
+		rollback(logCtx.WithField("IP", ip))
+		return "", err
+	}
+
+	pool, block := assignmentPoolAndBlock(v4Assignments.IPs[0], cidrs)
+	logCtx.WithFields(log.Fields{
+		"IP":    ip,
+		"pool":  pool,
+		"block": block,
+	}).Info("Assigned tunnel address to node")
+	counterTunnelAddrAssignments.WithLabelValues(attrType, pool).Inc()
+	return ip, nil
+}
+
+// assignmentPoolAndBlock returns the CIDRs of the pool and IPAM block that an assigned address was carved from.
+// AutoAssign returns each address with the mask of its block, so the block is derived from that.
+func assignmentPoolAndBlock(assigned net.IPNet, cidrs []net.IPNet) (pool, block string) {
+	for _, cidr := range cidrs {
+		if cidr.Contains(assigned.IP) {
+			pool = cidr.String()
+			break
 		}
+	}
+	block = (&gnet.IPNet{IP: assigned.IP.Mask(assigned.Mask), Mask: assigned.Mask}).String()
+	return pool, block
+}
 
-		// Log the error and exit with exit code 1.
-		logCtx.WithError(err).WithField("IP", ip).Fatal("Unable to set tunnel address")
+// checkAssignments checks that AutoAssign granted the requested number of addresses, returning ErrPoolExhausted if
+// none were granted and ErrPartialAssignment if only some were.
+func checkAssignments(assignments *ipam.IPAMAssignments, requested int) error {
+	granted := len(assignments.IPs)
+	if granted >= requested {
+		return nil
+	} else if granted == 0 {
+		return ErrPoolExhausted{Err: assignments.PartialFulfillmentError()}
 	}
+	return ErrPartialAssignment{Requested: requested, Granted: granted}
+}
 
-	logCtx.WithField("IP", ip).Info("Assigned tunnel address to node")
+// checkStrictAffinity returns ErrStrictAffinity wrapping the exhaustion error if IPAM strict affinity is enabled, since
+// the exhaustion is then likely due to the node's blocks being full rather than the pools. AutoAssign will already
+// have tried to claim a new block for the node. Otherwise the exhaustion error is returned unchanged.
+func checkStrictAffinity(ctx context.Context, c client.Interface, nodename string, exhaustedErr error, logCtx *log.Entry) error {
+	ipamConfig, err := c.IPAM().GetIPAMConfig(ctx)
+	if err != nil {
+		logCtx.WithError(err).Warn("Failed to get IPAM config, unable to check for strict affinity")
+		return exhaustedErr
+	} else if !ipamConfig.StrictAffinity {
+		return exhaustedErr
+	}
+	return ErrStrictAffinity{Node: nodename, MaxBlocksPerHost: ipamConfig.MaxBlocksPerHost, Err: exhaustedErr}
 }
 
-func updateNodeWithAddress(ctx context.Context, c client.Interface, nodename string, addr string, attrType string) error {
-	// If the update fails with ResourceConflict error then retry 5 times with 1 second delay before failing.
-	for i := 0; i < 5; i++ {
-		node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+// rollbackAssignment releases the addresses assigned with the handle after a failed assignment. The failure may be
+// due to the context being cancelled, so a separate context is used to make sure the addresses are not leaked.
+func rollbackAssignment(c client.Interface, handle string, logCtx *log.Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	if err := c.IPAM().ReleaseByHandle(ctx, handle); err != nil {
+		logCtx.WithError(err).Errorf("Error releasing IP address on failure")
+	}
+}
+
+// releaseHandleAddrsExcept releases the addresses assigned with the handle other than those supplied, rolling back a
+// failed assignment without releasing the addresses the handle held beforehand. As for rollbackAssignment, a separate
+// context is used.
+func releaseHandleAddrsExcept(c client.Interface, handle string, keep []net.IP, logCtx *log.Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	ips, err := c.IPAM().IPsByHandle(ctx, handle)
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			logCtx.WithError(err).Errorf("Error getting addresses to release on failure")
+		}
+		return
+	}
+	var release []net.IP
+	for _, ip := range ips {
+		if !containsIP(keep, ip) {
+			release = append(release, ip)
+		}
+	}
+	if len(release) == 0 {
+		return
+	}
+	if _, err := c.IPAM().ReleaseIPs(ctx, release); err != nil {
+		logCtx.WithError(err).Errorf("Error releasing IP address on failure")
+	}
+}
+
+// containsIP returns whether the address is in the list.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseAssignedAddr releases a single newly assigned address. As for rollbackAssignment, a separate context is used.
+func releaseAssignedAddr(c client.Interface, addr gnet.IP, logCtx *log.Entry) {
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	if _, err := c.IPAM().ReleaseIPs(ctx, []net.IP{{IP: addr}}); err != nil {
+		logCtx.WithError(err).Errorf("Error releasing IP address")
+	}
+}
+
+// errTunnelAddrSetConcurrently is returned by updateNodeWithAddress when, after a conflict, the node is found to
+// already have a valid tunnel address set by another writer.
+var errTunnelAddrSetConcurrently = errors.New("tunnel address was set concurrently")
+
+// updateNodeWithAddress sets the tunnel address on the node. If the update conflicts, the node is re-read and the
+// update retried, unless another writer has since set a tunnel address that is within the supplied pools and
+// allocated to the node, in which case errTunnelAddrSetConcurrently is returned rather than overwriting it. A successful
+// update is recorded in the audit log with the supplied reason.
+func updateNodeWithAddress(ctx context.Context, c client.Interface, conf *Config, nodename string, addr string, cidrs []net.IPNet, attrType string, reason AuditReason) error {
+	// Refuse to write an address that the readers of the node may not be able to parse.
+	if err := validateTunnelAddress(addr, cidrs); err != nil {
+		getLogger(ctx, attrType).WithError(err).Error("Refusing to write invalid tunnel address to the node")
+		return err
+	}
+
+	// If the update fails with ResourceConflict error then retry with a delay before failing.
+	start := getClock(ctx).Now()
+	var err error
+	for i := 0; i < nodeUpdateAttempts; i++ {
+		var node *libapi.Node
+		node, err = c.Nodes().Get(ctx, nodename, options.GetOptions{})
 		if err != nil {
-			return err
+			return nodeOperationError("get", nodename, err)
 		}
 
-		switch attrType {
-		case ipam.AttributeTypeVXLAN:
-			node.Spec.IPv4VXLANTunnelAddr = addr
-		case ipam.AttributeTypeIPIP:
-			if node.Spec.BGP == nil {
-				node.Spec.BGP = &libapi.NodeBGPSpec{}
-			}
-			node.Spec.BGP.IPv4IPIPTunnelAddr = addr
-		case ipam.AttributeTypeWireguard:
-			if node.Spec.Wireguard == nil {
-				node.Spec.Wireguard = &libapi.NodeWireguardSpec{}
+		// If we are retrying after a conflict, check whether the conflicting update set a valid tunnel address.
+		if i > 0 {
+			if current := getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0]); current != "" && current != addr && isIpInPool(current, cidrs) {
+				if allocated, err := isTunnelAddrAllocated(ctx, c, nodename, current, attrType); err != nil {
+					return err
+				} else if allocated {
+					return errTunnelAddrSetConcurrently
+				}
 			}
-			node.Spec.Wireguard.InterfaceIPv4Address = addr
+		}
+
+		// Set the address in all of the configured fields, so that they are updated together.
+		oldAddr := getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0])
+		for _, field := range conf.tunnelAddrFields(attrType) {
+			setTunnelAddrField(node, field, addr)
 		}
 
 		_, err = c.Nodes().Update(ctx, node, options.SetOptions{})
 		if _, ok := err.(cerrors.ErrorResourceUpdateConflict); ok {
 			// Wait for a second and try again if there was a conflict during the resource update.
-			log.WithField("node", node.Name).WithError(err).Info("Error updating node, retrying.")
-			time.Sleep(1 * time.Second)
+			getLogger(ctx, attrType).WithField("node", node.Name).WithFields(retryFields(ctx, i+1, nodeUpdateAttempts, start)).WithError(err).Info("Error updating node, retrying.")
+			if err := retrySleep(ctx, nodeUpdateRetryInterval, err); err != nil {
+				return err
+			}
 			continue
+		} else if err != nil {
+			return nodeOperationError("update", nodename, err)
 		}
 
+		auditTunnelAddrChange(ctx, conf, nodename, attrType, oldAddr, addr, reason)
 		return nil
 	}
-	return fmt.Errorf("Too many retries attempting to update node with tunnel address")
+	return ErrUpdateConflictTimeout{Node: nodename, Attempts: nodeUpdateAttempts, Err: err}
+}
+
+// isPoolNotFound returns whether an IPAM release failed because the address is not within any configured pool, i.e.
+// because its pool, or the block within it, has been deleted. IPAM reports a missing pool or block as a missing
+// resource with its key, but reports an address outside any configured pool as a plain error, so that is matched on
+// the message.
+func isPoolNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+	var notExist cerrors.ErrorResourceDoesNotExist
+	if errors.As(err, &notExist) {
+		switch notExist.Identifier.(type) {
+		case model.IPPoolKey, model.BlockKey:
+			return true
+		}
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not in a configured pool") || strings.Contains(msg, "pool not found")
+}
+
+// nodeOperationError returns the error for a failed operation on the node. A missing node is returned as
+// ErrNodeNotFound, permission errors as ErrPermissionDenied, naming the verb that the allocator needs on the nodes
+// resource, and anything else as ErrDatastoreUnavailable.
+func nodeOperationError(verb, nodename string, err error) error {
+	switch err.(type) {
+	case cerrors.ErrorResourceDoesNotExist:
+		return ErrNodeNotFound{Node: nodename, Err: err}
+	case cerrors.ErrorConnectionUnauthorized:
+		return ErrPermissionDenied{Verb: verb, Resource: "nodes", Err: err}
+	}
+	return ErrDatastoreUnavailable{Operation: fmt.Sprintf("%s node '%s'", verb, nodename), Err: err}
 }
 
 // removeHostTunnelAddr removes any existing IP address for this host's
 // tunnel device and releases the IP from IPAM.  If no IP is assigned this function
 // is a no-op.
-func removeHostTunnelAddr(ctx context.Context, c client.Interface, nodename string, attrType string) {
+func removeHostTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename string, attrType string) error {
 	var updateError error
-	logCtx := getLogger(attrType)
+	var ipAddr *net.IP
+	var ipAddrStr string
+	logCtx := getLogger(ctx, attrType)
 
-	// If the update fails with ResourceConflict error then retry 5 times with 1 second delay before failing.
-	for i := 0; i < 5; i++ {
+	// If the update fails with ResourceConflict error then retry with a delay before failing.
+	start := getClock(ctx).Now()
+	for i := 0; i < nodeUpdateAttempts; i++ {
 		node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
 		if err != nil {
-			logCtx.WithError(err).Fatalf("Unable to retrieve tunnel address for cleanup. Error getting node '%s'", nodename)
-		}
-
-		// Find out the currently assigned address and remove it from the node.
-		var ipAddrStr string
-		var ipAddr *net.IP
-		switch attrType {
-		case ipam.AttributeTypeVXLAN:
-			ipAddrStr = node.Spec.IPv4VXLANTunnelAddr
-			node.Spec.IPv4VXLANTunnelAddr = ""
-		case ipam.AttributeTypeIPIP:
-			if node.Spec.BGP != nil {
-				ipAddrStr = node.Spec.BGP.IPv4IPIPTunnelAddr
-				node.Spec.BGP.IPv4IPIPTunnelAddr = ""
-
-				// If removing the tunnel address causes the BGP spec to be empty, then nil it out.
-				// libcalico asserts that if a BGP spec is present, that it not be empty.
-				if reflect.DeepEqual(*node.Spec.BGP, libapi.NodeBGPSpec{}) {
-					logCtx.Debug("BGP spec is now empty, setting to nil")
-					node.Spec.BGP = nil
-				}
-			}
-		case ipam.AttributeTypeWireguard:
-			if node.Spec.Wireguard != nil {
-				ipAddrStr = node.Spec.Wireguard.InterfaceIPv4Address
-				node.Spec.Wireguard.InterfaceIPv4Address = ""
-
-				if reflect.DeepEqual(*node.Spec.Wireguard, libapi.NodeWireguardSpec{}) {
-					logCtx.Debug("Wireguard spec is now empty, setting to nil")
-					node.Spec.Wireguard = nil
-				}
-			}
+			return nodeOperationError("get", nodename, err)
+		}
+
+		if isUserManagedTunnelAddr(node, attrType) {
+			logCtx.WithField("currentAddr", getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0])).Info("Tunnel address is user-managed, not removing it")
+			return nil
+		}
+
+		// Find out the currently assigned address and remove it from all of the configured fields.
+		fields := conf.tunnelAddrFields(attrType)
+		ipAddrStr = getTunnelAddrField(node, fields[0])
+		ipAddr = nil
+		for _, field := range fields {
+			setTunnelAddrField(node, field, "")
 		}
 
 		if ipAddrStr != "" {
 			ipAddr = net.ParseIP(ipAddrStr)
 		}
 
-		// Release tunnel IP address(es) for the node.
+		// Release tunnel IP address(es) for the node, or if the release is deferred, record the address on the node for
+		// the gc command to release.
 		handle, _ := generateHandleAndAttributes(nodename, attrType)
-		if err := c.IPAM().ReleaseByHandle(ctx, handle); err != nil {
+		if conf.DeferredRelease {
+			if ipAddr != nil {
+				logCtx.WithFields(log.Fields{"IP": ipAddrStr, "handle": handle}).Info("Deferring the release of the tunnel address")
+				recordPendingRelease(node, ipAddr.String(), handle)
+			}
+		} else if err := c.IPAM().ReleaseByHandle(ctx, handle); isPoolNotFound(err) {
+			// The pool was deleted while the address was still set on the node, so the address is orphaned and there
+			// is nothing left to release. Just clear it from the node.
+			logCtx.WithError(err).WithField("IP", ipAddrStr).Info("The pool of the tunnel address no longer exists, clearing it from the node")
+		} else if err != nil {
 			if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
 				// Unknown error releasing the address.
 				logCtx.WithError(err).WithFields(log.Fields{
 					"IP":     ipAddrStr,
 					"Handle": handle,
-				}).Fatal("Error releasing address by handle")
+				}).Error("Error releasing address by handle")
+				return ErrDatastoreUnavailable{Operation: fmt.Sprintf("release handle '%s'", handle), Err: err}
 			}
 
 			if ipAddr != nil {
@@ -559,13 +1303,13 @@ func removeHostTunnelAddr(ctx context.Context, c client.Interface, nodename stri
 				attr, handle, err := c.IPAM().GetAssignmentAttributes(ctx, *ipAddr)
 				if err != nil {
 					if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
-						logCtx.WithError(err).Fatal("Failed to query attributes")
+						return ErrDatastoreUnavailable{Operation: fmt.Sprintf("get assignment attributes for '%s'", ipAddrStr), Err: err}
 					}
 					// No allocation exists, we don't have anything to do.
 				} else if len(attr) == 0 && handle == nil {
 					// The IP is ours. Release it by passing the exact IP.
-					if _, err := c.IPAM().ReleaseIPs(ctx, []net.IP{*ipAddr}); err != nil {
-						logCtx.WithError(err).WithField("IP", ipAddr.String()).Fatal("Error releasing address from IPAM")
+					if err := releaseIPs(ctx, c, []net.IP{*ipAddr}, logCtx); err != nil {
+						return err
 					}
 				}
 			}
@@ -575,38 +1319,111 @@ func removeHostTunnelAddr(ctx context.Context, c client.Interface, nodename stri
 		_, updateError = c.Nodes().Update(ctx, node, options.SetOptions{})
 		if _, ok := updateError.(cerrors.ErrorResourceUpdateConflict); ok {
 			// Wait for a second and try again if there was a conflict during the resource update.
-			logCtx.Infof("Error updating node %s: %s. Retrying.", node.Name, err)
-			time.Sleep(1 * time.Second)
+			logCtx.WithField("node", node.Name).WithFields(retryFields(ctx, i+1, nodeUpdateAttempts, start)).WithError(updateError).Info("Error updating node, retrying.")
+			if err := retrySleep(ctx, nodeUpdateRetryInterval, updateError); err != nil {
+				return err
+			}
 			continue
 		}
 
 		break
 	}
 
-	// Check to see if there was still an error after the retry loop,
-	// and log and exit if there was an error.
-	if updateError != nil {
-		// We hit an error, so release the IP address before exiting.
-		// Log the error and exit with exit code 1.
-		logCtx.WithError(updateError).Fatal("Unable to remove tunnel address")
+	// Check to see if there was still an error after the retry loop.
+	if _, ok := updateError.(cerrors.ErrorResourceUpdateConflict); ok {
+		return ErrUpdateConflictTimeout{Node: nodename, Attempts: nodeUpdateAttempts, Err: updateError}
+	} else if updateError != nil {
+		return nodeOperationError("update", nodename, updateError)
+	}
+	if conf.DeferredRelease {
+		auditTunnelAddrChange(ctx, conf, nodename, attrType, ipAddrStr, "", AuditReasonReleaseDeferred)
+		return nil
+	}
+	auditTunnelAddrChange(ctx, conf, nodename, attrType, ipAddrStr, "", AuditReasonReleased)
+
+	if conf.ReleaseTunnelBlockAffinity && ipAddr != nil {
+		releaseTunnelBlockAffinity(ctx, c, conf.ipamHostname(nodename), *ipAddr, logCtx)
 	}
+	return nil
 }
 
-// determineEnabledPools returns all enabled pools. If vxlan is true, then it will only return VXLAN pools. Otherwise
-// it will only return IPIP enabled pools.
-func determineEnabledPoolCIDRs(node libapi.Node, ipPoolList api.IPPoolList, attrType string) []net.IPNet {
-	// For wireguard, return no valid pools if the wireguard public key has not been set. Only once wireguard has been
-	// enabled *and* the wireguard device has been initialized do we require an IP address to be configured.
-	if attrType == ipam.AttributeTypeWireguard && node.Status.WireguardPublicKey == "" {
-		log.Debugf("Wireguard is not running on node %s", node.Name)
-		return nil
+// releaseTunnelBlockAffinity releases the node's affinity to the IPAM block containing the released tunnel address,
+// provided that the block is now empty. Failures are logged rather than returned since the tunnel address itself has
+// already been removed, and leaving the block affine to the node is harmless.
+func releaseTunnelBlockAffinity(ctx context.Context, c client.Interface, host string, addr net.IP, logCtx *log.Entry) {
+	logCtx = logCtx.WithField("IP", addr.String())
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		logCtx.WithError(err).Warn("Failed to list IP pools, not releasing block affinity")
+		return
 	}
 
-	var cidrs []net.IPNet
+	for _, ipPool := range ipPoolList.Items {
+		_, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR)
+		if err != nil || poolCidr.Version() != addr.Version() || !poolCidr.Contains(addr.IP) {
+			continue
+		}
+
+		// Determine the block from the pool block size.
+		bits := 32
+		if addr.Version() == 6 {
+			bits = 128
+		}
+		mask := gnet.CIDRMask(ipPool.Spec.BlockSize, bits)
+		if mask == nil {
+			logCtx.WithField("blockSize", ipPool.Spec.BlockSize).Warn("Invalid pool block size, not releasing block affinity")
+			return
+		}
+		block := net.IPNet{IPNet: gnet.IPNet{IP: addr.Mask(mask), Mask: mask}}
+
+		// Only release the affinity if the block is empty, i.e. the tunnel address was the last allocation.
+		logCtx = logCtx.WithField("block", block.String())
+		if err := c.IPAM().ReleaseAffinity(ctx, block, host, true); err != nil {
+			logCtx.WithError(err).Info("Block affinity not released, the block may still be in use")
+			return
+		}
+		logCtx.Info("Released block affinity")
+		return
+	}
+	logCtx.Debug("No IP pool contains the address, not releasing block affinity")
+}
+
+// poolIndex maps each tunnel address type to the CIDRs of the enabled pools that a tunnel address of that type may be
+// assigned from. It is built once per reconcile so that the pool list is only processed once for all tunnel types.
+type poolIndex map[string][]net.IPNet
+
+// tunnelPoolUse returns whether the pool may be used for tunnel addresses, and whether it is dedicated to them. A pool
+// with no allowed uses allows both workload and tunnel use.
+func tunnelPoolUse(ipPool api.IPPool) (allowed, dedicated bool) {
+	uses := ipPool.Spec.AllowedUses
+	if len(uses) == 0 {
+		return true, false
+	}
+	allowed = containsAllowedUse(uses, api.IPPoolAllowedUseTunnel)
+	return allowed, allowed && !containsAllowedUse(uses, api.IPPoolAllowedUseWorkload)
+}
+
+// containsAllowedUse returns whether the allowed uses include the specified use.
+func containsAllowedUse(uses []api.IPPoolAllowedUse, use api.IPPoolAllowedUse) bool {
+	for _, u := range uses {
+		if u == use {
+			return true
+		}
+	}
+	return false
+}
+
+// newPoolIndex builds the poolIndex for the node from the supplied pool list. Pools that do not allow tunnel use are
+// skipped. If any of the pools for a tunnel type are dedicated to tunnel use, only those pools are used for that type,
+// so that tunnel addresses do not consume pools shared with workloads.
+func newPoolIndex(node libapi.Node, ipPoolList api.IPPoolList) poolIndex {
+	idx := poolIndex{}
+	dedicatedIdx := poolIndex{}
 	for _, ipPool := range ipPoolList.Items {
 		_, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR)
 		if err != nil {
-			log.WithError(err).Fatalf("Failed to parse CIDR '%s' for IPPool '%s'", ipPool.Spec.CIDR, ipPool.Name)
+			log.WithError(err).Errorf("Failed to parse CIDR '%s' for IPPool '%s', skipping", ipPool.Spec.CIDR, ipPool.Name)
+			continue
 		}
 
 		// Check if IP pool selects the node
@@ -618,49 +1435,166 @@ func determineEnabledPoolCIDRs(node libapi.Node, ipPoolList api.IPPoolList, attr
 			continue
 		}
 
-		// Check if desired encap is enabled in the IP pool, the IP pool is not disabled, and it is IPv4 pool since we
-		// don't support encap with IPv6.
-		switch attrType {
-		case ipam.AttributeTypeVXLAN:
-			if (ipPool.Spec.VXLANMode == api.VXLANModeAlways || ipPool.Spec.VXLANMode == api.VXLANModeCrossSubnet) && !ipPool.Spec.Disabled && poolCidr.Version() == 4 {
-				cidrs = append(cidrs, *poolCidr)
-			}
-		case ipam.AttributeTypeIPIP:
-			// Check if IPIP is enabled in the IP pool, the IP pool is not disabled, and it is IPv4 pool since we don't support IPIP with IPv6.
-			if (ipPool.Spec.IPIPMode == api.IPIPModeCrossSubnet || ipPool.Spec.IPIPMode == api.IPIPModeAlways) && !ipPool.Spec.Disabled && poolCidr.Version() == 4 {
-				cidrs = append(cidrs, *poolCidr)
-			}
-		case ipam.AttributeTypeWireguard:
-			// Wireguard does not require a specific encap configuration on the pool.
-			if !ipPool.Spec.Disabled && poolCidr.Version() == 4 {
-				cidrs = append(cidrs, *poolCidr)
-			}
+		// Check the IP pool is not disabled, and it is IPv4 pool since we don't support encap with IPv6. In particular,
+		// there is no IPv6 equivalent of the IPv4IPIPTunnelAddr field in the node BGP spec to store a v6 IPIP tunnel
+		// address in, so IPv6 pools are never used for tunnel addresses even if they have IPIP enabled.
+		// For the same reason there is no choice of address family to make, so there is no family preference option:
+		// a node can only ever be assigned IPv4 tunnel addresses, and IPv6 pools never compete with IPv4 pools.
+		if ipPool.Spec.Disabled || poolCidr.Version() != 4 {
+			continue
+		}
+
+		// Check the IP pool allows tunnel addresses, and add it to the dedicated index if it is only for tunnels.
+		allowed, dedicated := tunnelPoolUse(ipPool)
+		if !allowed {
+			log.Debugf("IPPool '%s' does not allow tunnel use", ipPool.Name)
+			continue
 		}
+		target := idx
+		if dedicated {
+			target = dedicatedIdx
+		}
+
+		// Check if desired encap is enabled in the IP pool.
+		if ipPool.Spec.VXLANMode == api.VXLANModeAlways || ipPool.Spec.VXLANMode == api.VXLANModeCrossSubnet {
+			target[ipam.AttributeTypeVXLAN] = append(target[ipam.AttributeTypeVXLAN], *poolCidr)
+		}
+		if ipPool.Spec.IPIPMode == api.IPIPModeCrossSubnet || ipPool.Spec.IPIPMode == api.IPIPModeAlways {
+			target[ipam.AttributeTypeIPIP] = append(target[ipam.AttributeTypeIPIP], *poolCidr)
+		}
+
+		// Wireguard does not require a specific encap configuration on the pool. However, return no valid pools if the
+		// wireguard public key has not been set. Only once wireguard has been enabled *and* the wireguard device has
+		// been initialized do we require an IP address to be configured.
+		if node.Status.WireguardPublicKey != "" {
+			target[ipam.AttributeTypeWireguard] = append(target[ipam.AttributeTypeWireguard], *poolCidr)
+		}
+	}
+
+	// Prefer the pools dedicated to tunnel use, falling back to the shared pools if there are none.
+	for attrType, cidrs := range dedicatedIdx {
+		idx[attrType] = cidrs
+	}
+
+	if node.Status.WireguardPublicKey == "" {
+		log.Debugf("Wireguard is not running on node %s", node.Name)
+	}
+	return idx
+}
+
+// EncapEnabledPoolCIDRs returns the CIDRs of the enabled IPv4 pools in the list that select the node and that a tunnel
+// address of the specified type may be assigned from. The encapType is one of ipam.AttributeTypeIPIP,
+// ipam.AttributeTypeVXLAN or ipam.AttributeTypeWireguard. IPIP and VXLAN addresses are assigned from pools with that
+// encapsulation set to Always or CrossSubnet, while Wireguard addresses may be assigned from any pool once the node has
+// a wireguard public key. Pools that do not allow tunnel use are skipped, and pools dedicated to tunnel use are preferred
+// over those shared with workloads. Pools with an invalid CIDR or node selector are skipped.
+func EncapEnabledPoolCIDRs(node libapi.Node, ipPoolList api.IPPoolList, encapType string) []net.IPNet {
+	return newPoolIndex(node, ipPoolList)[encapType]
+}
+
+// isIPv6Only returns whether the enabled pools are all IPv6 pools, and there is at least one.
+func isIPv6Only(ipPoolList api.IPPoolList) bool {
+	v6 := false
+	for _, ipPool := range ipPoolList.Items {
+		_, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR)
+		if err != nil || ipPool.Spec.Disabled {
+			continue
+		} else if poolCidr.Version() == 4 {
+			return false
+		}
+		v6 = true
 	}
-	return cidrs
+	return v6
+}
+
+// determineEnabledPoolCIDRs returns the CIDRs of all enabled pools that a tunnel address of the specified type may be
+// assigned from.
+func determineEnabledPoolCIDRs(node libapi.Node, ipPoolList api.IPPoolList, attrType string) []net.IPNet {
+	return EncapEnabledPoolCIDRs(node, ipPoolList, attrType)
 }
 
-// isIpInPool returns if the IP address is in one of the supplied pools.
+// isIpInPool returns if the IP address is in one of the supplied pools. Only pools of the same address family as the
+// IP address are considered, and an address that cannot be parsed is never in a pool.
 func isIpInPool(ipAddrStr string, cidrs []net.IPNet) bool {
-	ipAddress := net.ParseIP(ipAddrStr)
+	ipAddress := parseTunnelIP(ipAddrStr)
+	if ipAddress == nil {
+		return false
+	}
 	for _, cidr := range cidrs {
-		if cidr.Contains(ipAddress.IP) {
+		if cidr.Version() == ipAddress.Version() && cidr.Contains(ipAddress.IP) {
 			return true
 		}
 	}
 	return false
 }
 
-func getLogger(attrType string) *log.Entry {
+// isIpInPoolByFamily checks the supplied IPv4 and IPv6 tunnel addresses against the pools of the matching address
+// family, returning the validity of each independently. An empty address, or an address supplied for the wrong
+// family, is never valid.
+func isIpInPoolByFamily(ipv4AddrStr, ipv6AddrStr string, cidrs []net.IPNet) (v4Valid, v6Valid bool) {
+	if ip := parseTunnelIP(ipv4AddrStr); ip != nil && ip.Version() == 4 {
+		v4Valid = isIpInPool(ipv4AddrStr, cidrs)
+	}
+	if ip := parseTunnelIP(ipv6AddrStr); ip != nil && ip.Version() == 6 {
+		v6Valid = isIpInPool(ipv6AddrStr, cidrs)
+	}
+	return
+}
+
+// parseTunnelIP parses a tunnel address, normalizing IPv4 addresses to their 4-byte form so that comparisons are
+// consistent regardless of how the address was parsed. Returns nil if the address is empty or invalid.
+func parseTunnelIP(ipAddrStr string) *net.IP {
+	if normalized, err := normalizeTunnelAddr(ipAddrStr); err == nil {
+		ipAddrStr = normalized
+	}
+	ipAddress := net.ParseIP(ipAddrStr)
+	if ipAddress == nil {
+		return nil
+	}
+	if v4 := ipAddress.To4(); v4 != nil {
+		ipAddress.IP = v4
+	}
+	return ipAddress
+}
+
+// sleepCtx sleeps for the supplied duration, returning the context error early if the context is done first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	return getClock(ctx).Sleep(ctx, d)
+}
+
+// getLogger returns a logger for the tunnel address type, which includes the reconcile run ID if the context has one.
+func getLogger(ctx context.Context, attrType string) *log.Entry {
+	logCtx := log.NewEntry(log.StandardLogger())
+	if runID, ok := ctx.Value(runIDKey{}).(string); ok {
+		logCtx = logCtx.WithField("run_id", runID)
+	}
+
 	switch attrType {
 	case ipam.AttributeTypeVXLAN:
-		return log.WithField("type", "vxlanTunnelAddress")
+		return logCtx.WithField("type", "vxlanTunnelAddress")
 	case ipam.AttributeTypeIPIP:
-		return log.WithField("type", "ipipTunnelAddress")
+		return logCtx.WithField("type", "ipipTunnelAddress")
 	case ipam.AttributeTypeWireguard:
-		return log.WithField("type", "wireguardTunnelAddress")
+		return logCtx.WithField("type", "wireguardTunnelAddress")
 	}
-	return nil
+	return logCtx
+}
+
+// runIDKey is the context key for the reconcile run ID.
+type runIDKey struct{}
+
+// withRunID returns a copy of the context tagged with the supplied reconcile run ID.
+func withRunID(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, runID)
+}
+
+// newRunID returns a short random ID used to correlate the logs of a single reconcile.
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
 }
 
 // backendClientAccessor is an interface to access the backend client from the main v2 client.
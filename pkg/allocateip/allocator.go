@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// Allocator assigns and releases node tunnel addresses. It allows the allocation logic to be used as a library by
+// other components, rather than through Run which reads its configuration from the environment. All methods return
+// errors rather than exiting.
+type Allocator struct {
+	client        client.Interface
+	conf          *Config
+	reassignments *reassignmentLimiter
+
+	// err is the problem with the configuration, if any, which is returned by every operation.
+	err error
+}
+
+// NewAllocator returns an Allocator that uses the supplied client and configuration. A nil configuration gives the
+// default behavior. The datastore operations made through the client are timed. If the configuration has problems,
+// every operation of the Allocator fails with an ErrInvalidConfig.
+func NewAllocator(c client.Interface, conf *Config) *Allocator {
+	return NewAllocatorWithIPAM(c, conf, nil)
+}
+
+// NewAllocatorWithIPAM returns an Allocator as for NewAllocator, but which assigns and releases tunnel addresses
+// through the supplied TunnelIPAM rather than the client's IPAM. A nil TunnelIPAM uses the client's IPAM.
+func NewAllocatorWithIPAM(c client.Interface, conf *Config, tunnelIPAM TunnelIPAM) *Allocator {
+	if conf == nil {
+		conf = &Config{}
+	}
+	if tunnelIPAM != nil {
+		c = newTunnelIPAMClient(c, tunnelIPAM)
+	}
+	return &Allocator{
+		client:        newTimedClient(c, conf.SlowOperationThreshold, conf.OperationTimeout),
+		conf:          conf,
+		reassignments: newReassignmentLimiter(conf),
+		err:           conf.check(),
+	}
+}
+
+// Reconcile assigns or removes each type of tunnel address of the node according to the enabled IP pools, returning
+// the result for each managed type.
+func (a *Allocator) Reconcile(ctx context.Context, nodename string) (map[string]TunnelAddrResult, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	return reconcileTunnelAddrs(withReassignmentLimit(ctx, a.reassignments), nodename, a.client, a.conf)
+}
+
+// EnsureTunnelAddress ensures the node has a tunnel address of the specified type, one of ipam.AttributeTypeIPIP,
+// ipam.AttributeTypeVXLAN or ipam.AttributeTypeWireguard, if there are enabled pools for that type. If there are none,
+// any existing address of that type is removed. As when Run reconciles the node, the node lock is held throughout, the
+// IPv4 pools override is applied, no address is assigned until the node is ready if so configured, and an unmanaged
+// type, or IPIP on a Windows node, is left unchanged.
+func (a *Allocator) EnsureTunnelAddress(ctx context.Context, nodename, encapType string) (TunnelAddrResult, error) {
+	if a.err != nil {
+		return ResultNoChange, a.err
+	}
+	if err := checkTunnelAttrType(encapType); err != nil {
+		return ResultNoChange, err
+	}
+	unlock, err := lockNode(ctx, a.conf, nodename)
+	if err != nil {
+		return ResultNoChange, err
+	}
+	defer unlock()
+	ctx = withRetryBudget(withRunID(ctx, newRunID()), a.conf.RetryBudget)
+	ctx = withReassignmentLimit(ctx, a.reassignments)
+
+	node, err := a.client.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		return ResultNoChange, nodeOperationError("get", nodename, err)
+	}
+	_, pools, err := listTunnelPools(ctx, a.client, a.conf, node)
+	if err != nil {
+		return ResultNoChange, err
+	}
+
+	state := desiredTunnelState(node, pools, a.conf)[encapType]
+	logCtx := getLogger(ctx, encapType).WithField("node", nodename)
+	switch state.Action {
+	case tunnelActionSkip:
+		logCtx.Infof("Leaving the tunnel address unchanged, %s", state.Reason)
+		return ResultNoChange, nil
+	case tunnelActionRemove:
+		if state.Addr != "" {
+			logCtx.WithField("IP", state.Addr).Infof("Removing the tunnel address, %s", state.Reason)
+		}
+		err = removeHostTunnelAddr(ctx, a.client, a.conf, nodename, encapType)
+	default:
+		if a.conf.RequireNodeReady {
+			if ready, err := isNodeReadyForAssignment(ctx, a.client, nodename); err != nil {
+				return ResultNoChange, err
+			} else if !ready {
+				logCtx.Info("Node is not ready, skipping tunnel address assignment")
+				return ResultNoChange, ErrNodeNotReady{Node: nodename}
+			}
+		}
+		logCtx.WithField("reason", state.Reason).Debugf("%s tunnel address", state.Action)
+		err = ensureHostTunnelAddress(ctx, a.client, a.conf, node, state, encapType)
+	}
+	if err != nil {
+		return ResultNoChange, err
+	}
+	return a.result(ctx, node, encapType)
+}
+
+// RemoveTunnelAddress removes the node's tunnel address of the specified type and releases it, holding the node lock
+// as for EnsureTunnelAddress. Removal does not wait for the node to be ready.
+func (a *Allocator) RemoveTunnelAddress(ctx context.Context, nodename, encapType string) (TunnelAddrResult, error) {
+	if a.err != nil {
+		return ResultNoChange, a.err
+	}
+	if err := checkTunnelAttrType(encapType); err != nil {
+		return ResultNoChange, err
+	}
+	unlock, err := lockNode(ctx, a.conf, nodename)
+	if err != nil {
+		return ResultNoChange, err
+	}
+	defer unlock()
+	ctx = withRetryBudget(withRunID(ctx, newRunID()), a.conf.RetryBudget)
+
+	node, err := a.client.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		return ResultNoChange, nodeOperationError("get", nodename, err)
+	}
+	if err := removeHostTunnelAddr(ctx, a.client, a.conf, nodename, encapType); err != nil {
+		return ResultNoChange, err
+	}
+	return a.result(ctx, node, encapType)
+}
+
+// result returns the result for the tunnel address type, compared with the node as it was before.
+func (a *Allocator) result(ctx context.Context, before *libapi.Node, attrType string) (TunnelAddrResult, error) {
+	results, err := getTunnelAddrResults(ctx, a.client, a.conf, before, []string{attrType})
+	if err != nil {
+		return ResultNoChange, err
+	}
+	return results[attrType], nil
+}
+
+// checkTunnelAttrType returns an error if the tunnel address type is not one managed by the allocator.
+func checkTunnelAttrType(attrType string) error {
+	for _, t := range tunnelAttrTypes {
+		if t == attrType {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown tunnel address type '%s'", attrType)
+}
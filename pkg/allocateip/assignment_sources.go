@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	gnet "net"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	log "github.com/sirupsen/logrus"
+)
+
+// assignmentSource identifies where an assigned tunnel address came from, for logging.
+type assignmentSource string
+
+const (
+	assignmentSourceHandle        assignmentSource = "handle"
+	assignmentSourceDeterministic assignmentSource = "deterministic"
+	assignmentSourceSubCIDR       assignmentSource = "sub-CIDR"
+	assignmentSourceAutoAssign    assignmentSource = "autoassign"
+)
+
+// assignTunnelAddr assigns a tunnel address from the pools under the handle and attributes in args, trying each source
+// of address in order of precedence until one provides an address:
+//
+//  1. The address already allocated with the node's handle, if it is the only one and is within the pools, e.g. one
+//     left by an interrupted run or reserved by the reserve command. It is adopted rather than allocating another.
+//  2. If the deterministic assignment strategy is configured, the node's deterministic address in the pools.
+//  3. If a sub-CIDR is configured, the first free address within it, to which the pools are already constrained.
+//     Otherwise, the address chosen by AutoAssign from the pools picked by the pool selection strategy.
+//
+// A source that cannot provide an address falls through to the next, except for the last, which is authoritative.
+// If AutoAssign assigns nothing, the empty assignments are returned for the caller to diagnose the exhaustion.
+func assignTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename string, cidrs []net.IPNet, attrType string, args ipam.AutoAssignArgs, logCtx *log.Entry) (*ipam.IPAMAssignments, assignmentSource, error) {
+	if v4Assignments := handleAddr(ctx, c, *args.HandleID, cidrs, logCtx); v4Assignments != nil {
+		return v4Assignments, assignmentSourceHandle, nil
+	}
+
+	if conf.TunnelAddrSubCIDR != "" {
+		v4Assignments, err := assignSubCIDRAddr(ctx, c, cidrs[0], args.Hostname, *args.HandleID, args.Attrs, logCtx)
+		if err != nil {
+			return nil, assignmentSourceSubCIDR, err
+		} else if v4Assignments == nil {
+			return nil, assignmentSourceSubCIDR, ErrPoolExhausted{Err: fmt.Errorf("no free addresses in tunnel address sub-CIDR %s", cidrs[0].String())}
+		}
+		return v4Assignments, assignmentSourceSubCIDR, nil
+	}
+
+	pools, err := selectPools(ctx, c, conf, cidrs)
+	if err != nil {
+		return nil, assignmentSourceAutoAssign, err
+	}
+	args.IPv4Pools = pools
+	if conf.AssignmentStrategy == AssignmentDeterministic {
+		if v4Assignments := assignDeterministicAddr(ctx, c, nodename, args.Hostname, pools, *args.HandleID, args.Attrs, logCtx); v4Assignments != nil {
+			return v4Assignments, assignmentSourceDeterministic, nil
+		}
+	}
+
+	v4Assignments, err := autoAssign(ctx, c, conf, args, attrType, logCtx)
+	if err != nil {
+		return nil, assignmentSourceAutoAssign, ErrDatastoreUnavailable{Operation: "autoassign tunnel address", Err: err}
+	}
+	return v4Assignments, assignmentSourceAutoAssign, nil
+}
+
+// handleAddr returns the address allocated with the handle as an assignment, if the handle holds exactly one address
+// and it is within the pools, or nil otherwise.
+func handleAddr(ctx context.Context, c client.Interface, handle string, cidrs []net.IPNet, logCtx *log.Entry) *ipam.IPAMAssignments {
+	ips, err := c.IPAM().IPsByHandle(ctx, handle)
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+			logCtx.WithError(err).WithField("handle", handle).Warn("Unable to get the addresses allocated with our handle, assigning a new address")
+		}
+		return nil
+	}
+	if len(ips) != 1 || !isIpInPool(ips[0].String(), cidrs) {
+		return nil
+	}
+	return &ipam.IPAMAssignments{
+		IPs:          []net.IPNet{{IPNet: gnet.IPNet{IP: ips[0].IP, Mask: gnet.CIDRMask(32, 32)}}},
+		IPVersion:    4,
+		NumRequested: 1,
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditReason describes why a tunnel address was written to or removed from a node, as recorded in the audit log.
+type AuditReason string
+
+const (
+	// AuditReasonAssigned means an address was assigned from the enabled pools, either because the node had none or
+	// to replace one that is no longer valid.
+	AuditReasonAssigned AuditReason = "Assigned"
+
+	// AuditReasonReused means an address already allocated with the node's handle was set on the node.
+	AuditReasonReused AuditReason = "ReusedHandleAddress"
+
+	// AuditReasonNormalized means the address was rewritten without the CIDR suffix it was stored with.
+	AuditReasonNormalized AuditReason = "RemovedCIDRSuffix"
+
+	// AuditReasonMigrated means the address was replaced by one from another pool by the migrate command.
+	AuditReasonMigrated AuditReason = "Migrated"
+
+	// AuditReasonReleased means the address was removed from the node and released, because the node no longer needs
+	// a tunnel address of the type or its removal was requested.
+	AuditReasonReleased AuditReason = "Released"
+
+	// AuditReasonReleaseDeferred means the address was removed from the node, but its release was deferred to the gc
+	// command.
+	AuditReasonReleaseDeferred AuditReason = "ReleaseDeferred"
+
+	// AuditReasonCleared means the address was cleared from the node without being released by the clear command.
+	AuditReasonCleared AuditReason = "Cleared"
+
+	// AuditReasonDuplicate means the address was cleared from the node because another node has it allocated.
+	AuditReasonDuplicate AuditReason = "Duplicate"
+)
+
+// auditEntry is a single line of the audit log.
+type auditEntry struct {
+	Time   time.Time        `json:"time"`
+	RunID  string           `json:"runID,omitempty"`
+	Node   string           `json:"node"`
+	Type   string           `json:"type"`
+	Action TunnelAddrResult `json:"action"`
+	OldIP  string           `json:"oldIP"`
+	NewIP  string           `json:"newIP"`
+	Reason AuditReason      `json:"reason"`
+}
+
+// auditLock serializes the writes to the audit log, so that concurrent entries are not interleaved.
+var auditLock sync.Mutex
+
+// auditTunnelAddrChange appends an entry for a change to the node's tunnel address to the audit log, if one is
+// configured. The change has already been made, so a failure to record it is logged rather than returned.
+func auditTunnelAddrChange(ctx context.Context, conf *Config, nodename, attrType, oldAddr, newAddr string, reason AuditReason) {
+	if conf.AuditLogFile == "" || oldAddr == newAddr {
+		return
+	}
+	runID, _ := ctx.Value(runIDKey{}).(string)
+	entry := auditEntry{
+		Time:   getClock(ctx).Now().UTC(),
+		RunID:  runID,
+		Node:   nodename,
+		Type:   attrType,
+		Action: newTunnelAddrResult(oldAddr, newAddr),
+		OldIP:  oldAddr,
+		NewIP:  newAddr,
+		Reason: reason,
+	}
+	if err := appendAuditEntry(conf.AuditLogFile, entry); err != nil {
+		getLogger(ctx, attrType).WithError(err).WithField("file", conf.AuditLogFile).Error("Failed to write audit log entry")
+	}
+}
+
+// appendAuditEntry appends the entry to the audit log file as a line of JSON, creating the file if necessary. The file
+// is opened for each entry so that it may be rotated externally.
+func appendAuditEntry(path string, entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// batchResult is the outcome of reconciling the tunnel addresses of one node in a batch.
+type batchResult struct {
+	Node    string
+	Results map[string]TunnelAddrResult
+	Err     error
+}
+
+// runBatchCommand reconciles the tunnel addresses of each of the listed nodes in a single process, sharing the client
+// and the pool list between them. A failure for one node does not stop the others. The nodes are given with --nodes,
+// or read from stdin one per line. It exits non-zero if any node failed.
+func runBatchCommand(conf *Config, args []string) int {
+	fs := flag.NewFlagSet("batch", flag.ContinueOnError)
+	nodesFlag := fs.String("nodes", "", "Comma separated list of the nodes to reconcile, or - to read them from stdin")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	var nodes []string
+	if *nodesFlag == "-" {
+		var err error
+		if nodes, err = readNodeNames(os.Stdin); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read node names: %v\n", err)
+			return 1
+		}
+	} else {
+		for _, name := range strings.Split(*nodesFlag, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				nodes = append(nodes, name)
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		fmt.Fprintln(os.Stderr, "No nodes provided, use --nodes")
+		return 1
+	}
+
+	cfg, c := createClient(conf)
+	if cfg.Spec.K8sUsePodCIDR {
+		fmt.Println("Using host-local IPAM, no need to allocate tunnel addresses")
+		return 0
+	}
+	ctx, stop := signalContext()
+	defer stop()
+
+	// The pools are listed once and shared by all of the nodes in the batch.
+	a := NewAllocator(newPoolCacheClient(c, newPoolCache(0)), conf)
+	results := reconcileNodes(ctx, a, nodes)
+	if err := writeBatchTable(os.Stdout, results); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write results: %v\n", err)
+		return 1
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// readNodeNames reads node names from r, one per line, ignoring blank lines.
+func readNodeNames(r io.Reader) ([]string, error) {
+	var nodes []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			nodes = append(nodes, name)
+		}
+	}
+	return nodes, scanner.Err()
+}
+
+// reconcileNodes reconciles the tunnel addresses of each node in turn, recording the results or error of each. It
+// stops early only if the context is cancelled, in which case the remaining nodes are recorded with the context error.
+func reconcileNodes(ctx context.Context, a *Allocator, nodes []string) []batchResult {
+	results := make([]batchResult, 0, len(nodes))
+	for _, nodename := range nodes {
+		if err := ctx.Err(); err != nil {
+			results = append(results, batchResult{Node: nodename, Err: err})
+			continue
+		}
+		r, err := a.Reconcile(ctx, nodename)
+		if err != nil {
+			log.WithError(err).WithField("node", nodename).Warn("Failed to reconcile tunnel addresses, continuing with the next node")
+		}
+		results = append(results, batchResult{Node: nodename, Results: r, Err: err})
+	}
+	return results
+}
+
+// writeBatchTable writes the result of each tunnel address type for each node in the batch, or the error if the node
+// failed.
+func writeBatchTable(w io.Writer, results []batchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tIPIP\tVXLAN\tWIREGUARD\tERROR")
+	for _, r := range results {
+		row := []string{r.Node}
+		for _, attrType := range tunnelAttrTypes {
+			result, ok := r.Results[attrType]
+			if !ok {
+				result = "-"
+			}
+			row = append(row, string(result))
+		}
+		errStr := "-"
+		if r.Err != nil {
+			errStr = r.Err.Error()
+		}
+		fmt.Fprintln(tw, strings.Join(append(row, errStr), "\t"))
+	}
+	return tw.Flush()
+}
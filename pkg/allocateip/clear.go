@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnelTypeNames maps the tunnel type names accepted by the commands to the IPAM attribute types.
+var tunnelTypeNames = map[string]string{
+	"ipip":      ipam.AttributeTypeIPIP,
+	"vxlan":     ipam.AttributeTypeVXLAN,
+	"wireguard": ipam.AttributeTypeWireguard,
+}
+
+// clearedField is a node field cleared by the clear command, and the value it held.
+type clearedField struct {
+	Field string
+	Value string
+}
+
+// runClearCommand blanks the node's tunnel address fields of a single type, without releasing the address. This is an
+// escape hatch for recovering from a corrupt tunnel address that cannot be released, after which the normal reconcile
+// assigns a fresh address.
+func runClearCommand(conf *Config, nodename string, args []string) int {
+	fs := flag.NewFlagSet("clear", flag.ContinueOnError)
+	node := fs.String("node", nodename, "Name of the node to clear the tunnel address fields of")
+	typeFlag := fs.String("type", "", "Type of tunnel address to clear: ipip, vxlan or wireguard")
+	confirm := fs.Bool("confirm", false, "Confirm that the fields should be cleared without releasing the address")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	attrType, ok := tunnelTypeNames[strings.ToLower(*typeFlag)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Invalid --type %q, must be one of ipip, vxlan or wireguard\n", *typeFlag)
+		return 1
+	}
+	if *node == "" {
+		fmt.Fprintln(os.Stderr, "NODENAME environment is not set, use --node")
+		return 1
+	}
+	if !*confirm {
+		fmt.Fprintf(os.Stderr, "Not clearing the %s address of node '%s' without --confirm, the address will not be released\n", *typeFlag, *node)
+		return 1
+	}
+
+	_, c := createClient(conf)
+	ctx, stop := signalContext()
+	defer stop()
+
+	cleared, err := clearTunnelAddrFields(withRunID(ctx, newRunID()), c, conf, *node, attrType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to clear the %s address of node '%s': %v\n", *typeFlag, *node, err)
+		return 1
+	}
+	if len(cleared) == 0 {
+		fmt.Printf("The %s address fields of node '%s' are already empty\n", *typeFlag, *node)
+	}
+	for _, f := range cleared {
+		fmt.Printf("Cleared %s of node '%s', was %q\n", f.Field, *node, f.Value)
+	}
+	return 0
+}
+
+// clearTunnelAddrFields blanks the node's fields for the tunnel address type without parsing or releasing the address,
+// returning the fields that were set and their previous values. Each cleared field is logged.
+func clearTunnelAddrFields(ctx context.Context, c client.Interface, conf *Config, nodename, attrType string) ([]clearedField, error) {
+	logCtx := getLogger(ctx, attrType).WithField("node", nodename)
+
+	// If the update fails with ResourceConflict error then retry with a delay before failing.
+	start := getClock(ctx).Now()
+	var err error
+	for i := 0; i < nodeUpdateAttempts; i++ {
+		var node *libapi.Node
+		node, err = c.Nodes().Get(ctx, nodename, options.GetOptions{})
+		if err != nil {
+			return nil, nodeOperationError("get", nodename, err)
+		}
+
+		var cleared []clearedField
+		for _, field := range conf.tunnelAddrFields(attrType) {
+			if value := getTunnelAddrField(node, field); value != "" {
+				cleared = append(cleared, clearedField{Field: field, Value: value})
+				setTunnelAddrField(node, field, "")
+			}
+		}
+		if len(cleared) == 0 {
+			return nil, nil
+		}
+
+		_, err = c.Nodes().Update(ctx, node, options.SetOptions{})
+		if _, ok := err.(cerrors.ErrorResourceUpdateConflict); ok {
+			logCtx.WithFields(retryFields(ctx, i+1, nodeUpdateAttempts, start)).WithError(err).Info("Error updating node, retrying.")
+			if err := retrySleep(ctx, nodeUpdateRetryInterval, err); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, nodeOperationError("update", nodename, err)
+		}
+
+		for _, f := range cleared {
+			logCtx.WithFields(log.Fields{"field": f.Field, "value": f.Value}).Warn("Cleared tunnel address field without releasing the address")
+		}
+		auditTunnelAddrChange(ctx, conf, nodename, attrType, cleared[0].Value, "", AuditReasonCleared)
+		return cleared, nil
+	}
+	return nil, ErrUpdateConflictTimeout{Node: nodename, Attempts: nodeUpdateAttempts, Err: err}
+}
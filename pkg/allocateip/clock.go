@@ -0,0 +1,71 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"time"
+)
+
+// clock is the source of time for the retry loops, reconcile intervals and reassignment limits, so that tests can
+// control time rather than waiting for it to pass.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep sleeps for the supplied duration, returning the context error early if the context is done first.
+	Sleep(ctx context.Context, d time.Duration) error
+
+	// After returns a channel that receives the time once the supplied duration has elapsed.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// clockKey is the context key for the clock.
+type clockKey struct{}
+
+// withClock returns a copy of the context that uses the supplied clock.
+func withClock(ctx context.Context, clk clock) context.Context {
+	return context.WithValue(ctx, clockKey{}, clk)
+}
+
+// getClock returns the context's clock, or the real clock if it has none.
+func getClock(ctx context.Context) clock {
+	if clk, ok := ctx.Value(clockKey{}).(clock); ok {
+		return clk
+	}
+	return realClock{}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"fmt"
+	"os"
+)
+
+// RunCommand runs the named tunnel ip allocator subcommand, e.g. "status" or "duplicates", with the remaining arguments, and returns
+// the process exit code. If nodename is empty, the node is taken from the configured NodeName. The configuration is
+// as loaded by LoadConfig.
+func RunCommand(conf *Config, nodename string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "No command provided")
+		return 1
+	}
+	if nodename == "" {
+		nodename = conf.NodeName
+	}
+
+	switch args[0] {
+	case "status":
+		return runStatusCommand(conf, nodename, args[1:])
+	case "duplicates":
+		return runDuplicatesCommand(conf, args[1:])
+	case "migrate":
+		return runMigrateCommand(conf, nodename, args[1:])
+	case "preflight":
+		return runPreflightCommand(conf, nodename, args[1:])
+	case "export":
+		return runExportCommand(conf, args[1:])
+	case "clear":
+		return runClearCommand(conf, nodename, args[1:])
+	case "batch":
+		return runBatchCommand(conf, args[1:])
+	case "selftest":
+		return runSelftestCommand(conf, nodename, args[1:])
+	case "reserve":
+		return runReserveCommand(conf, nodename, args[1:])
+	case "gc":
+		return runGCCommand(conf, args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "Unknown command %q, valid commands are: status, duplicates, migrate, preflight, export, clear, batch, selftest, reserve, gc\n", args[0])
+	return 1
+}
@@ -0,0 +1,564 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config contains the configuration of the tunnel IP allocator. The zero value gives the default behavior.
+type Config struct {
+	// StickyTunnelAddrs leaves an existing tunnel address in place when it is no longer within one of the enabled
+	// pools, rather than releasing it and assigning a new one. This avoids churning tunnel addresses across the
+	// cluster when a pool is briefly removed from the set of encapsulation enabled pools during maintenance.
+	StickyTunnelAddrs bool
+
+	// DeferredRelease defers the release of the tunnel addresses removed from nodes, which are instead recorded on the
+	// node with AnnotationPendingRelease and released in batches by the gc command. This avoids a storm of releases
+	// against IPAM during a mass scale-down, at the cost of the addresses remaining allocated until the gc command is
+	// run. By default, addresses are released as they are removed.
+	DeferredRelease bool
+
+	// ManualReassignment disables the automatic reassignment of tunnel addresses that are no longer within one of the
+	// enabled pools for all nodes, as for nodes with AnnotationManualReassignment. Unlike StickyTunnelAddrs, this is
+	// expected to be temporary: the reassignment is reported as required on each run until it is allowed to go ahead.
+	ManualReassignment bool
+
+	// ReleaseTunnelBlockAffinity releases the node's affinity to the IPAM block of a removed tunnel address if that
+	// address was the last allocation in the block. Otherwise the block remains affine to the node.
+	ReleaseTunnelBlockAffinity bool
+
+	// PoolSelection is the strategy used to choose which of the enabled pools a tunnel address is assigned from. If
+	// unset, the first pool with space is used.
+	PoolSelection PoolSelectionStrategy
+
+	// AssignmentStrategy is how the address is picked within the chosen pools. If unset, IPAM assigns the first free
+	// address. See AssignmentDeterministic for the caveats of deriving the address from the node name.
+	AssignmentStrategy AssignmentStrategy
+
+	// MetricsAddr is the address, e.g. ":9095", on which the Prometheus metrics are served in daemon mode. If unset,
+	// metrics are not served.
+	MetricsAddr string
+
+	// MetricsSocket is the path of a Unix socket on which the Prometheus metrics are served in daemon mode, instead of
+	// MetricsAddr, so that a local sidecar can scrape them without a network port being opened on the node. At most one
+	// of MetricsAddr and MetricsSocket may be set, and the allocator fails at startup if both are.
+	MetricsSocket string
+
+	// RequireNodeReady holds off assigning tunnel addresses until the Kubernetes node is Ready. This only applies when
+	// using the Kubernetes datastore.
+	RequireNodeReady bool
+
+	// TunnelAddrFields maps a tunnel address type to the node fields that the address is stored in, which is useful
+	// when migrating between fields. The address is read from the first field and written to all of them in a single
+	// update. Types with no entry use the default field for the type.
+	TunnelAddrFields map[string][]string
+
+	// TunnelBlockSize, if set, restricts tunnel address assignment to the enabled pools with this block size. IPAM
+	// allocates blocks using the blockSize configured on each pool, so this cannot change the size of the blocks in a
+	// pool. Instead, to keep tunnel addresses out of the blocks intended for pods, create a dedicated pool with a small
+	// blockSize for tunnel addresses and set this to match. Assignment fails with ErrIncompatibleBlockSize if none of
+	// the enabled pools has this block size.
+	TunnelBlockSize int
+
+	// DetectDuplicateTunnelAddrs checks for tunnel addresses claimed by more than one node after each reconcile in
+	// daemon mode, logging and counting them in a metric. This lists all nodes, so is intended for diagnosis rather
+	// than permanent use in large clusters.
+	DetectDuplicateTunnelAddrs bool
+
+	// ResolveDuplicateTunnelAddrs removes a duplicate tunnel address from this node if another node has it allocated
+	// in IPAM, so that this node is assigned a new one. It only applies when DetectDuplicateTunnelAddrs is set.
+	ResolveDuplicateTunnelAddrs bool
+
+	// UnmanagedTunnelAddrTypes are the tunnel address types that reconciliation neither assigns nor removes, leaving
+	// whatever is configured on the node untouched. This allows a type to be managed externally on some nodes.
+	UnmanagedTunnelAddrTypes map[string]bool
+
+	// OptionalTunnelAddrs treats exhaustion of the enabled pools as a warning rather than an error, leaving the node
+	// without a tunnel address of that type. This allows best-effort tunnel addressing from deliberately small pools
+	// without the allocator failing on the nodes that miss out.
+	OptionalTunnelAddrs bool
+
+	// SlowOperationThreshold is the duration above which a datastore operation is logged as slow. If unset, a default
+	// of two seconds is used. The durations of all operations are recorded in a metric regardless.
+	SlowOperationThreshold time.Duration
+
+	// OperationTimeout bounds the duration of each datastore operation made while reconciling, separately from any
+	// deadline of the run as a whole, so that one slow call cannot starve the calls after it. The operation that
+	// timed out is logged. If unset, a default of thirty seconds is used.
+	OperationTimeout time.Duration
+
+	// ChangedExitCode, if set, is the exit code used in single-shot mode when any tunnel address was assigned,
+	// reassigned or removed, so that automation can tell whether anything changed. Otherwise the exit code is zero.
+	ChangedExitCode int
+
+	// RetryBudget, if set, bounds the total time spent waiting between retries across all of the tunnel types in a
+	// single reconcile. Once it is used up, operations that would retry fail with ErrRetryBudgetExhausted.
+	RetryBudget time.Duration
+
+	// StrictPoolValidation fails startup with ErrMixedEncapPools if any enabled pool has both IPIP and VXLAN
+	// encapsulation enabled, rather than just logging a warning.
+	StrictPoolValidation bool
+
+	// ReconcileInterval, if set, periodically reconciles the tunnel addresses in daemon mode, in addition to the
+	// reconciliations triggered by configuration changes. A failed reconciliation is then retried rather than exiting
+	// the daemon, with the interval doubling after each consecutive failure up to MaxReconcileInterval, and resetting
+	// on success.
+	ReconcileInterval time.Duration
+
+	// MaxReconcileInterval caps the reconcile interval after consecutive failures. If unset, a default of five minutes
+	// is used.
+	MaxReconcileInterval time.Duration
+
+	// ClusterID, if set, is recorded in the AttributeClusterID attribute of each tunnel address allocation, so that the
+	// allocations of each cluster can be told apart when auditing a datastore shared between clusters.
+	ClusterID string
+
+	// DatastoreCertFile, DatastoreKeyFile and DatastoreCACertFile, if set, are the client certificate, key and CA
+	// certificate files used to connect to the datastore, taking precedence over those in the datastore client
+	// configuration. They apply to etcd or the Kubernetes API server, depending on the datastore type.
+	DatastoreCertFile   string
+	DatastoreKeyFile    string
+	DatastoreCACertFile string
+
+	// EtcdKeyPrefix, if set, is the prefix of the Calico keys in etcd, which is logged at startup. Only the default
+	// prefix, "/calico", is supported by the etcd client, so the allocator fails to start with any other, rather than
+	// writing the tunnel address handles and attributes outside of the expected subtree.
+	EtcdKeyPrefix string
+
+	// MaxReassignmentsPerReconcile, if set, caps the number of tunnel addresses reassigned in a single reconcile
+	// because they are no longer within an enabled pool. Further reassignments are suppressed, leaving the current
+	// address in place, which protects against churn when the pool configuration is oscillating.
+	MaxReassignmentsPerReconcile int
+
+	// MaxReassignmentsPerWindow and ReassignmentWindow, if both set, cap the number of such reassignments within any
+	// window of that duration, across reconciles in daemon mode.
+	MaxReassignmentsPerWindow int
+	ReassignmentWindow        time.Duration
+
+	// ReassignmentCooldown, if set, is the minimum time between reassignments of the same tunnel type on the same
+	// node, across reconciles in daemon mode. A reassignment within the cooldown is deferred, leaving the current
+	// address in place, so that two consecutive reconciles cannot flap the address back and forth. The time of the
+	// last reassignment is only held in memory, so the cooldown applies only in daemon mode and restarts with the
+	// process. It has no effect in single-shot mode, where each run starts afresh.
+	ReassignmentCooldown time.Duration
+
+	// ExternalTunnelAddrProgramming stores each tunnel address in a node annotation, e.g. AnnotationVXLANTunnelAddr,
+	// rather than in the canonical node spec field, for deployments where a separate agent owns the canonical fields
+	// and programs the tunnel device. The allocator then only manages the IPAM allocation and the annotation. Types
+	// with an entry in TunnelAddrFields use those fields instead, which must not include the canonical fields.
+	ExternalTunnelAddrProgramming bool
+
+	// TunnelAddrPools maps a tunnel address type to the names of the pools that its addresses are assigned from,
+	// overriding the discovery of pools by their encapsulation. This allows each type to be given a distinct pool. The
+	// named pools must still be enabled, select the node and allow tunnel use. Types with no entry use discovery.
+	TunnelAddrPools map[string][]string
+
+	// PreserveForeignTunnelAddrs leaves a tunnel address in place, with a warning, if it is outside the enabled pools
+	// and not allocated to the node in IPAM, rather than assigning a new one. Such an address was most likely set
+	// manually, e.g. to an intentionally external address. Unlike a user-managed address, see
+	// AnnotationUserManagedTunnelAddrs, an address in an enabled pool is still reassigned if it is not ours.
+	PreserveForeignTunnelAddrs bool
+
+	// SkipTunnelAddrOwnershipCheck keeps a tunnel address that is in one of the pools without checking that it is
+	// allocated to the node in IPAM, saving a datastore read on every reconcile. By default the allocation is checked,
+	// and an address that is not ours, e.g. after the IPAM data was restored from a backup, is repaired or replaced.
+	SkipTunnelAddrOwnershipCheck bool
+
+	// ReassignmentOrder is the order in which an old tunnel address is released and a new one assigned when the
+	// address is replaced. If unset, the new address is assigned first so that the node is never without one. An
+	// unknown order is rejected at startup.
+	ReassignmentOrder ReassignmentOrder
+
+	// ExtraHandleAddrs is what to do when the handle of a valid tunnel address also holds other addresses that are not
+	// set on the node. If unset, the other addresses are released. An unknown policy is rejected at startup.
+	ExtraHandleAddrs ExtraHandleAddrsPolicy
+
+	// ZoneLabel, if set, is the label key, e.g. "topology.kubernetes.io/zone", that identifies the zone of a node. An
+	// IP pool labelled with the same key is tagged for that zone, and tunnel addresses are assigned from the pools
+	// tagged for the node's zone in preference to the others, falling back to any eligible pool if there are none.
+	ZoneLabel string
+
+	// PreferNodeSubnetPools prefers the pool overlapping the subnet of each node's primary IPv4 address when assigning
+	// its tunnel addresses, as for nodes with AnnotationPreferNodeSubnet.
+	PreferNodeSubnetPools bool
+
+	// ExhaustionHook, if set, is invoked when no tunnel address can be assigned because the pools are exhausted, so
+	// that an external controller can add capacity, e.g. by creating another pool. It is either an http or https URL,
+	// to which the node name, tunnel type and exhausted pool names are posted as JSON, or the path of a command, which
+	// is run with the tunnel type and pool names as its arguments. Assignment is then retried ExhaustionRetries times.
+	ExhaustionHook string
+
+	// ExhaustionRetries is the number of times assignment is retried after invoking the ExhaustionHook, before failing
+	// with ErrPoolExhausted. If unset, a default of three is used.
+	ExhaustionRetries int
+
+	// IPAMHostname, if set, is the host that tunnel addresses are assigned to in IPAM, and so the host that their
+	// blocks are affine to, for setups where it differs from the name of the Calico node resource, e.g. an FQDN rather
+	// than a short name. The node resource name is still recorded in the allocation attributes. If unset, the node
+	// name is used.
+	IPAMHostname string
+
+	// AuditLogFile, if set, is the path of a file to which a line of JSON is appended for every change made to a
+	// node's tunnel address, recording the time, node, tunnel type, old and new addresses and the reason. Unlike the
+	// general logs, this is intended to be retained as an audit trail.
+	AuditLogFile string
+
+	// PoolCacheResync is the maximum age of the IP pools cached between reconciles in daemon mode, after which they
+	// are listed again in case a change was missed. If unset, a default of five minutes is used.
+	PoolCacheResync time.Duration
+
+	// TunnelAddrSubCIDR, if set, confines tunnel addresses to this IPv4 CIDR, e.g. the first /28 of a larger pool, so
+	// that firewall rules can match the tunnel endpoints without a separate pool. It must be within one of the pools
+	// eligible for each type of tunnel address, and no larger than a /20, since its addresses are tried in turn. An
+	// address outside it is reassigned.
+	TunnelAddrSubCIDR string
+
+	// NodeLockDir is the directory of the lock files that serialize the reconciles of concurrent invocations for the
+	// same node, see lockNode. If unset, /var/run/calico is used. NodeLockTimeout is how long an invocation waits for
+	// another to release the lock before failing, or thirty seconds if unset.
+	NodeLockDir     string
+	NodeLockTimeout time.Duration
+
+	// IPv4PoolsOverride, if set, are the pool CIDRs that each type of tunnel address with eligible pools is assigned
+	// from, in place of the pools chosen by the usual pool selection. It is intended for debugging and one-off
+	// operations, so it is never loaded from the environment, only set by RunForNodeWithIPv4Pools.
+	IPv4PoolsOverride []net.IPNet
+
+	// LogFieldNames renames structured log fields, mapping the default key, one of "type", "node", "Node", "IP",
+	// "handle" or "run_id", to the key it is logged under, for log pipelines with a fixed schema. Fields with no entry
+	// keep their default keys.
+	LogFieldNames map[string]string
+
+	// NodeName is the name of this node, from the NODENAME environment. Run manages the tunnel addresses of this node,
+	// and the commands default to it.
+	NodeName string
+
+	// LogLevel is the log level, e.g. "debug", from the CALICO_LOG_LEVEL environment, falling back to LOG_LEVEL, so
+	// that the debug logs can be enabled without rebuilding. If unset or invalid, the info level is used.
+	LogLevel string
+}
+
+// ExtraHandleAddrsPolicy determines what is done with addresses held by a tunnel address handle that are not set on
+// the node.
+type ExtraHandleAddrsPolicy string
+
+const (
+	// ExtraHandleAddrsRelease releases the extra addresses, keeping the one set on the node. This is the default.
+	ExtraHandleAddrsRelease ExtraHandleAddrsPolicy = "release"
+
+	// ExtraHandleAddrsFail leaves the extra addresses in place and fails the reconcile, for manual intervention.
+	ExtraHandleAddrsFail ExtraHandleAddrsPolicy = "fail"
+)
+
+// ReassignmentOrder determines whether the old tunnel address is released before or after its replacement is assigned.
+type ReassignmentOrder string
+
+const (
+	// ReassignmentOrderMakeBeforeBreak assigns the new address and sets it on the node before releasing the old
+	// addresses. This is the default.
+	ReassignmentOrderMakeBeforeBreak ReassignmentOrder = "make-before-break"
+
+	// ReassignmentOrderBreakBeforeMake releases the old addresses before assigning the new one, leaving the node
+	// without a tunnel address in between. If the release fails, the old address is left in place.
+	ReassignmentOrderBreakBeforeMake ReassignmentOrder = "break-before-make"
+)
+
+// AttributeClusterID is the IPAM allocation attribute that records the configured cluster ID.
+const AttributeClusterID = "cluster"
+
+// addClusterAttribute adds the cluster ID, if configured, to the allocation attributes.
+func (conf *Config) addClusterAttribute(attrs map[string]string) {
+	if conf.ClusterID != "" {
+		attrs[AttributeClusterID] = conf.ClusterID
+	}
+}
+
+// ipamHostname returns the host that the node's tunnel addresses are assigned to in IPAM.
+func (conf *Config) ipamHostname(nodename string) string {
+	if conf.IPAMHostname != "" {
+		return conf.IPAMHostname
+	}
+	return nodename
+}
+
+// The range of IPv4 block sizes supported by IPAM.
+const (
+	minIPv4BlockSize = 20
+	maxIPv4BlockSize = 32
+)
+
+// configSource returns the value of a configuration variable, or an empty string if it is unset. It allows the
+// configuration to be supplied without mutating the process environment, for example in tests.
+type configSource func(key string) string
+
+// mapConfigSource returns a configSource that reads the variables from the supplied map.
+func mapConfigSource(vars map[string]string) configSource {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+// LoadConfig loads the tunnel IP allocator configuration from the environment. The caller may then apply any command
+// line flags to it before passing it to Run, RunForNode or RunCommand.
+func LoadConfig() *Config {
+	return loadConfigFrom(os.Getenv)
+}
+
+// loadConfigFrom loads the tunnel IP allocator configuration from the supplied source.
+func loadConfigFrom(src configSource) *Config {
+	return &Config{
+		StickyTunnelAddrs:          strings.ToLower(src("CALICO_STICKY_TUNNEL_ADDRS")) == "true",
+		ManualReassignment:         strings.ToLower(src("CALICO_TUNNEL_ADDR_MANUAL_REASSIGNMENT")) == "true",
+		DeferredRelease:            strings.ToLower(src("CALICO_TUNNEL_ADDR_DEFERRED_RELEASE")) == "true",
+		ReleaseTunnelBlockAffinity: strings.ToLower(src("CALICO_RELEASE_TUNNEL_BLOCK_AFFINITY")) == "true",
+		PoolSelection:              PoolSelectionStrategy(strings.ToLower(src("CALICO_TUNNEL_POOL_SELECTION"))),
+		AssignmentStrategy:         AssignmentStrategy(strings.ToLower(src("CALICO_TUNNEL_ADDR_ASSIGNMENT_STRATEGY"))),
+		MetricsAddr:                src("CALICO_TUNNEL_ALLOCATOR_METRICS_ADDR"),
+		MetricsSocket:              src("CALICO_TUNNEL_ALLOCATOR_METRICS_SOCKET"),
+		RequireNodeReady:           strings.ToLower(src("CALICO_TUNNEL_ADDRS_REQUIRE_NODE_READY")) == "true",
+		TunnelAddrFields: map[string][]string{
+			ipam.AttributeTypeIPIP:      parseTunnelAddrFields(src, "CALICO_IPIP_TUNNEL_ADDR_FIELDS"),
+			ipam.AttributeTypeVXLAN:     parseTunnelAddrFields(src, "CALICO_VXLAN_TUNNEL_ADDR_FIELDS"),
+			ipam.AttributeTypeWireguard: parseTunnelAddrFields(src, "CALICO_WIREGUARD_TUNNEL_ADDR_FIELDS"),
+		},
+		TunnelBlockSize:               parseTunnelBlockSize(src, "CALICO_TUNNEL_BLOCK_SIZE"),
+		DetectDuplicateTunnelAddrs:    strings.ToLower(src("CALICO_DETECT_DUPLICATE_TUNNEL_ADDRS")) == "true",
+		ResolveDuplicateTunnelAddrs:   strings.ToLower(src("CALICO_RESOLVE_DUPLICATE_TUNNEL_ADDRS")) == "true",
+		OptionalTunnelAddrs:           strings.ToLower(src("CALICO_OPTIONAL_TUNNEL_ADDRS")) == "true",
+		SlowOperationThreshold:        parseDuration(src, "CALICO_TUNNEL_ADDR_SLOW_OPERATION_THRESHOLD"),
+		OperationTimeout:              parseDuration(src, "CALICO_TUNNEL_ADDR_OPERATION_TIMEOUT"),
+		ChangedExitCode:               parseExitCode(src, "CALICO_TUNNEL_ADDRS_CHANGED_EXIT_CODE"),
+		RetryBudget:                   parseDuration(src, "CALICO_TUNNEL_ADDR_RETRY_BUDGET"),
+		StrictPoolValidation:          strings.ToLower(src("CALICO_TUNNEL_STRICT_POOL_VALIDATION")) == "true",
+		ReconcileInterval:             parseDuration(src, "CALICO_TUNNEL_ADDR_RECONCILE_INTERVAL"),
+		MaxReconcileInterval:          parseDuration(src, "CALICO_TUNNEL_ADDR_MAX_RECONCILE_INTERVAL"),
+		ClusterID:                     strings.TrimSpace(src("CALICO_TUNNEL_ADDR_CLUSTER_ID")),
+		DatastoreCertFile:             src("CALICO_TUNNEL_ADDR_DATASTORE_CERT_FILE"),
+		DatastoreKeyFile:              src("CALICO_TUNNEL_ADDR_DATASTORE_KEY_FILE"),
+		DatastoreCACertFile:           src("CALICO_TUNNEL_ADDR_DATASTORE_CA_CERT_FILE"),
+		EtcdKeyPrefix:                 strings.TrimSpace(src("CALICO_TUNNEL_ADDR_ETCD_KEY_PREFIX")),
+		MaxReassignmentsPerReconcile:  parseCount(src, "CALICO_TUNNEL_ADDR_MAX_REASSIGNMENTS_PER_RECONCILE"),
+		MaxReassignmentsPerWindow:     parseCount(src, "CALICO_TUNNEL_ADDR_MAX_REASSIGNMENTS_PER_WINDOW"),
+		ReassignmentWindow:            parseDuration(src, "CALICO_TUNNEL_ADDR_REASSIGNMENT_WINDOW"),
+		ReassignmentCooldown:          parseDuration(src, "CALICO_TUNNEL_ADDR_REASSIGNMENT_COOLDOWN"),
+		ExternalTunnelAddrProgramming: strings.ToLower(src("CALICO_TUNNEL_ADDRS_EXTERNAL_PROGRAMMING")) == "true",
+		PreserveForeignTunnelAddrs:    strings.ToLower(src("CALICO_PRESERVE_FOREIGN_TUNNEL_ADDRS")) == "true",
+		SkipTunnelAddrOwnershipCheck:  strings.ToLower(src("CALICO_TUNNEL_ADDR_VERIFY_OWNERSHIP")) == "false",
+		ReassignmentOrder:             ReassignmentOrder(strings.ToLower(src("CALICO_TUNNEL_ADDR_REASSIGNMENT_ORDER"))),
+		ExtraHandleAddrs:              ExtraHandleAddrsPolicy(strings.ToLower(src("CALICO_TUNNEL_ADDR_EXTRA_HANDLE_ADDRS"))),
+		ZoneLabel:                     strings.TrimSpace(src("CALICO_TUNNEL_ADDR_ZONE_LABEL")),
+		PreferNodeSubnetPools:         strings.ToLower(src("CALICO_TUNNEL_ADDR_PREFER_NODE_SUBNET")) == "true",
+		PoolCacheResync:               parseDuration(src, "CALICO_TUNNEL_ADDR_POOL_CACHE_RESYNC"),
+		ExhaustionHook:                strings.TrimSpace(src("CALICO_TUNNEL_ADDR_EXHAUSTION_HOOK")),
+		AuditLogFile:                  strings.TrimSpace(src("CALICO_TUNNEL_ADDR_AUDIT_LOG_FILE")),
+		IPAMHostname:                  strings.TrimSpace(src("CALICO_TUNNEL_ADDR_IPAM_HOSTNAME")),
+		ExhaustionRetries:             parseCount(src, "CALICO_TUNNEL_ADDR_EXHAUSTION_RETRIES"),
+		NodeLockDir:                   strings.TrimSpace(src("CALICO_TUNNEL_ADDR_LOCK_DIR")),
+		TunnelAddrSubCIDR:             strings.TrimSpace(src("CALICO_TUNNEL_ADDR_SUB_CIDR")),
+		NodeLockTimeout:               parseDuration(src, "CALICO_TUNNEL_ADDR_LOCK_TIMEOUT"),
+		LogFieldNames:                 parseLogFieldNames(src, "CALICO_TUNNEL_ADDR_LOG_FIELD_NAMES"),
+		NodeName:                      src("NODENAME"),
+		LogLevel:                      firstConfigValue(src, "CALICO_LOG_LEVEL", "LOG_LEVEL"),
+		TunnelAddrPools: map[string][]string{
+			ipam.AttributeTypeIPIP:      parsePoolNames(src("CALICO_IPIP_TUNNEL_ADDR_POOLS")),
+			ipam.AttributeTypeVXLAN:     parsePoolNames(src("CALICO_VXLAN_TUNNEL_ADDR_POOLS")),
+			ipam.AttributeTypeWireguard: parsePoolNames(src("CALICO_WIREGUARD_TUNNEL_ADDR_POOLS")),
+		},
+		UnmanagedTunnelAddrTypes: map[string]bool{
+			ipam.AttributeTypeIPIP:      strings.ToLower(src("CALICO_MANAGE_IPIP_TUNNEL_ADDR")) == "false",
+			ipam.AttributeTypeVXLAN:     strings.ToLower(src("CALICO_MANAGE_VXLAN_TUNNEL_ADDR")) == "false",
+			ipam.AttributeTypeWireguard: strings.ToLower(src("CALICO_MANAGE_WIREGUARD_TUNNEL_ADDR")) == "false",
+		},
+	}
+}
+
+// validate returns the problems with the configuration. Invalid environment values are already rejected when the
+// configuration is loaded, so this checks the settings that are individually valid but do not make sense together.
+func (conf *Config) validate() []error {
+	var errs []error
+	if _, ok := poolSelectors[conf.PoolSelection]; !ok && conf.PoolSelection != "" {
+		errs = append(errs, fmt.Errorf("unknown pool selection strategy %q", conf.PoolSelection))
+	}
+	switch conf.AssignmentStrategy {
+	case "", AssignmentAuto, AssignmentDeterministic:
+	default:
+		errs = append(errs, fmt.Errorf("unknown assignment strategy %q", conf.AssignmentStrategy))
+	}
+	switch conf.ReassignmentOrder {
+	case "", ReassignmentOrderMakeBeforeBreak, ReassignmentOrderBreakBeforeMake:
+	default:
+		errs = append(errs, fmt.Errorf("unknown reassignment order %q", conf.ReassignmentOrder))
+	}
+	if conf.MetricsAddr != "" && conf.MetricsSocket != "" {
+		errs = append(errs, errors.New("the metrics address and metrics socket must not both be set"))
+	}
+	switch conf.ExtraHandleAddrs {
+	case "", ExtraHandleAddrsRelease, ExtraHandleAddrsFail:
+	default:
+		errs = append(errs, fmt.Errorf("unknown extra handle addresses policy %q", conf.ExtraHandleAddrs))
+	}
+	if conf.TunnelBlockSize != 0 && (conf.TunnelBlockSize < minIPv4BlockSize || conf.TunnelBlockSize > maxIPv4BlockSize) {
+		errs = append(errs, fmt.Errorf("tunnel block size %d is not between %d and %d", conf.TunnelBlockSize, minIPv4BlockSize, maxIPv4BlockSize))
+	}
+	for _, attrType := range tunnelAttrTypes {
+		for _, field := range conf.TunnelAddrFields[attrType] {
+			if err := validateTunnelAddrField(field); err != nil {
+				errs = append(errs, err)
+			} else if conf.ExternalTunnelAddrProgramming && isCanonicalTunnelAddrField(field) {
+				errs = append(errs, fmt.Errorf("tunnel address field '%s' is owned by the external agent when tunnel addresses are programmed externally", field))
+			}
+		}
+	}
+	if conf.ResolveDuplicateTunnelAddrs && !conf.DetectDuplicateTunnelAddrs {
+		errs = append(errs, errors.New("resolving duplicate tunnel addresses has no effect unless detecting them is also enabled"))
+	}
+	if conf.MaxReconcileInterval != 0 && conf.ReconcileInterval == 0 {
+		errs = append(errs, errors.New("a maximum reconcile interval has no effect unless a reconcile interval is also set"))
+	} else if conf.MaxReconcileInterval != 0 && conf.MaxReconcileInterval < conf.ReconcileInterval {
+		errs = append(errs, fmt.Errorf("maximum reconcile interval %s is less than the reconcile interval %s", conf.MaxReconcileInterval, conf.ReconcileInterval))
+	}
+	if conf.TunnelAddrSubCIDR != "" {
+		if _, err := parseSubCIDR(conf.TunnelAddrSubCIDR); err != nil {
+			errs = append(errs, err)
+		} else if conf.AssignmentStrategy == AssignmentDeterministic {
+			errs = append(errs, errors.New("the deterministic assignment strategy has no effect when a tunnel address sub-CIDR is set"))
+		}
+	}
+	if conf.ExhaustionRetries != 0 && conf.ExhaustionHook == "" {
+		errs = append(errs, errors.New("exhaustion retries have no effect unless an exhaustion hook is also set"))
+	}
+	if (conf.MaxReassignmentsPerWindow == 0) != (conf.ReassignmentWindow == 0) {
+		errs = append(errs, errors.New("the maximum reassignments per window and the reassignment window must be set together"))
+	}
+	errs = append(errs, validateLogFieldNames(conf.LogFieldNames)...)
+	if err := conf.checkEtcdKeyPrefixSupported(); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// check returns an ErrInvalidConfig if the configuration has problems, so that a misconfiguration fails before the
+// allocator starts rather than being ignored or only warned about.
+func (conf *Config) check() error {
+	if problems := conf.validate(); len(problems) > 0 {
+		return ErrInvalidConfig{Problems: problems}
+	}
+	return nil
+}
+
+// parseTunnelAddrFields parses the comma separated list of tunnel address fields from the named variable.
+func parseTunnelAddrFields(src configSource, env string) []string {
+	var fields []string
+	for _, field := range strings.Split(src(env), ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if err := validateTunnelAddrField(field); err != nil {
+			log.WithError(err).Fatalf("Invalid value for %s", env)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// parseTunnelBlockSize parses the tunnel block size from the named variable, returning 0 if it is unset.
+func parseTunnelBlockSize(src configSource, env string) int {
+	value := strings.TrimSpace(src(env))
+	if value == "" {
+		return 0
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < minIPv4BlockSize || size > maxIPv4BlockSize {
+		log.Fatalf("Invalid value for %s: %q, must be a block size between %d and %d", env, value, minIPv4BlockSize, maxIPv4BlockSize)
+	}
+	return size
+}
+
+// parseDuration parses the duration from the named variable, returning 0 if it is unset.
+func parseDuration(src configSource, env string) time.Duration {
+	value := strings.TrimSpace(src(env))
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Fatalf("Invalid value for %s: %q, must be a positive duration", env, value)
+	}
+	return d
+}
+
+// parseExitCode parses an exit code from the named variable, returning 0 if it is unset.
+func parseExitCode(src configSource, env string) int {
+	value := strings.TrimSpace(src(env))
+	if value == "" {
+		return 0
+	}
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 0 || code > 125 {
+		log.Fatalf("Invalid value for %s: %q, must be an exit code between 0 and 125", env, value)
+	}
+	return code
+}
+
+// parseCount parses a non-negative count from the named variable, returning 0 if it is unset.
+func parseCount(src configSource, env string) int {
+	value := strings.TrimSpace(src(env))
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid value for %s: %q, must be a non-negative integer", env, value)
+	}
+	return n
+}
+
+// firstConfigValue returns the value of the first of the named variables that is set.
+func firstConfigValue(src configSource, keys ...string) string {
+	for _, key := range keys {
+		if value := src(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// configureLogging sets the configured log level.
+func (conf *Config) configureLogging() {
+	log.SetLevel(parseLogLevel(conf.LogLevel))
+}
+
+// parseLogLevel parses the log level, returning the info level if it is empty or invalid.
+func parseLogLevel(raw string) log.Level {
+	if raw == "" {
+		return log.InfoLevel
+	}
+	level, err := log.ParseLevel(raw)
+	if err != nil {
+		log.WithError(err).Warn("Failed to parse log level, defaulting to info")
+		return log.InfoLevel
+	}
+	return level
+}
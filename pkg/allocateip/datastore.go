@@ -0,0 +1,212 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"fmt"
+	gnet "net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/projectcalico/libcalico-go/lib/apiconfig"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/projectcalico/node/pkg/calicoclient"
+)
+
+// createClient creates the datastore client from the client config in the environment, with the TLS files in the
+// allocator configuration, if any, taking precedence over those in the client config. Both the Kubernetes and etcd
+// clients connect through the proxy in the standard HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment, so no proxy is
+// configured here, but the effective proxy is logged.
+func createClient(conf *Config) (*apiconfig.CalicoAPIConfig, client.Interface) {
+	cfg := calicoclient.LoadConfig()
+	applyDatastoreTLS(cfg, conf)
+	fields := log.Fields{
+		"datastore": cfg.Spec.DatastoreType,
+		"transport": transportSecurity(cfg),
+		"proxy":     datastoreProxy(cfg, http.ProxyFromEnvironment),
+	}
+	if cfg.Spec.DatastoreType != apiconfig.Kubernetes {
+		fields["etcdKeyPrefix"] = etcdKeyPrefix(conf)
+	}
+	if err := checkEtcdKeyPrefix(cfg, conf); err != nil {
+		log.WithFields(fields).WithError(err).Fatal("Unsupported etcd key prefix")
+	}
+	log.WithFields(fields).Debug("Creating datastore client")
+	return cfg, calicoclient.CreateClientFromConfig(cfg)
+}
+
+// applyDatastoreTLS sets the TLS files configured for the allocator in the client config of the datastore in use.
+func applyDatastoreTLS(cfg *apiconfig.CalicoAPIConfig, conf *Config) {
+	set := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	if cfg.Spec.DatastoreType == apiconfig.Kubernetes {
+		set(&cfg.Spec.K8sCertFile, conf.DatastoreCertFile)
+		set(&cfg.Spec.K8sKeyFile, conf.DatastoreKeyFile)
+		set(&cfg.Spec.K8sCAFile, conf.DatastoreCACertFile)
+		return
+	}
+	set(&cfg.Spec.EtcdCertFile, conf.DatastoreCertFile)
+	set(&cfg.Spec.EtcdKeyFile, conf.DatastoreKeyFile)
+	set(&cfg.Spec.EtcdCACertFile, conf.DatastoreCACertFile)
+}
+
+// transportSecurity describes the transport security that the client config results in, so that operators can
+// confirm from the debug logs whether mutual TLS is in use.
+func transportSecurity(cfg *apiconfig.CalicoAPIConfig) string {
+	spec := cfg.Spec
+	if spec.DatastoreType == apiconfig.Kubernetes {
+		switch {
+		case spec.Kubeconfig != "" || spec.KubeconfigInline != "":
+			return "as configured by the kubeconfig"
+		case spec.K8sInsecureSkipTLSVerify:
+			return "TLS without server verification"
+		case spec.K8sCertFile != "" && spec.K8sKeyFile != "":
+			return "mutual TLS"
+		case spec.K8sAPIEndpoint == "":
+			// Without an endpoint, the in-cluster config is used, which authenticates with the service account token.
+			return "TLS with service account token"
+		}
+		return "TLS"
+	}
+
+	for _, endpoint := range strings.Split(spec.EtcdEndpoints, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" && !strings.HasPrefix(endpoint, "https://") {
+			return "plaintext"
+		}
+	}
+	if (spec.EtcdCertFile != "" && spec.EtcdKeyFile != "") || (spec.EtcdCert != "" && spec.EtcdKey != "") {
+		return "mutual TLS"
+	}
+	return "TLS"
+}
+
+// datastoreProxy describes the proxy that the datastore client connects to each datastore endpoint through, as
+// determined by proxyFunc from the endpoint, so that operators can confirm from the debug logs that the proxy
+// environment is picked up. Other than in tests, proxyFunc is http.ProxyFromEnvironment, which is what the clients use.
+func datastoreProxy(cfg *apiconfig.CalicoAPIConfig, proxyFunc func(*http.Request) (*url.URL, error)) string {
+	spec := cfg.Spec
+	var endpoints []string
+	if spec.DatastoreType == apiconfig.Kubernetes {
+		switch {
+		case spec.K8sAPIEndpoint != "":
+			endpoints = []string{spec.K8sAPIEndpoint}
+		case spec.Kubeconfig != "" || spec.KubeconfigInline != "":
+			return "as configured by the kubeconfig"
+		case os.Getenv("KUBERNETES_SERVICE_HOST") != "":
+			endpoints = []string{"https://" + gnet.JoinHostPort(os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))}
+		}
+	} else {
+		for _, endpoint := range strings.Split(spec.EtcdEndpoints, ",") {
+			if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+				endpoints = append(endpoints, endpoint)
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		return "unknown"
+	}
+
+	var proxies []string
+	for _, endpoint := range endpoints {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			proxies = append(proxies, fmt.Sprintf("%s with invalid endpoint", endpoint))
+			continue
+		}
+		if spec.DatastoreType != apiconfig.Kubernetes {
+			// The etcd client connects with gRPC, which looks up the proxy as for an https URL, whatever the scheme of
+			// the endpoint.
+			u.Scheme = "https"
+		}
+		proxy, err := proxyFunc(&http.Request{URL: u})
+		switch {
+		case err != nil:
+			proxies = append(proxies, fmt.Sprintf("%s with invalid proxy: %v", endpoint, err))
+		case proxy == nil:
+			proxies = append(proxies, fmt.Sprintf("%s direct", endpoint))
+		default:
+			proxies = append(proxies, fmt.Sprintf("%s via %s", endpoint, proxy.Redacted()))
+		}
+	}
+	return strings.Join(proxies, ", ")
+}
+
+// defaultEtcdKeyPrefix is the prefix of the keys of all Calico resources and IPAM data in etcd.
+const defaultEtcdKeyPrefix = "/calico"
+
+// etcdKeyPrefix returns the configured etcd key prefix, or the default if none is configured.
+func etcdKeyPrefix(conf *Config) string {
+	if conf.EtcdKeyPrefix == "" {
+		return defaultEtcdKeyPrefix
+	}
+	return conf.EtcdKeyPrefix
+}
+
+// validateEtcdKeyPrefix checks that the etcd key prefix is well-formed: an absolute key path, e.g. "/calico", with no
+// trailing slash, empty or relative segments, or whitespace.
+func validateEtcdKeyPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("etcd key prefix '%s' must start with a '/' and must not end with one", prefix)
+	}
+	for _, segment := range strings.Split(prefix[1:], "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("etcd key prefix '%s' has an empty or relative path segment", prefix)
+		}
+		if strings.IndexFunc(segment, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+			return fmt.Errorf("etcd key prefix '%s' contains whitespace or unprintable characters", prefix)
+		}
+	}
+	return nil
+}
+
+// checkEtcdKeyPrefix checks that the configured etcd key prefix is well-formed and can be honored by the datastore
+// client. The etcd client in libcalico-go stores all resources and IPAM data under the default prefix, and has no
+// setting to change it, so any other prefix is rejected rather than the tunnel address handles and attributes silently
+// landing outside the configured subtree. A prefix has no meaning for the Kubernetes datastore, so is rejected there.
+func checkEtcdKeyPrefix(cfg *apiconfig.CalicoAPIConfig, conf *Config) error {
+	if conf.EtcdKeyPrefix == "" {
+		return nil
+	}
+	if err := conf.checkEtcdKeyPrefixSupported(); err != nil {
+		return err
+	}
+	if cfg.Spec.DatastoreType == apiconfig.Kubernetes {
+		return fmt.Errorf("etcd key prefix '%s' is set, but the datastore is Kubernetes", conf.EtcdKeyPrefix)
+	}
+	return nil
+}
+
+// checkEtcdKeyPrefixSupported checks that the configured etcd key prefix, if any, is well-formed and supported by the
+// etcd client, whatever the datastore.
+func (conf *Config) checkEtcdKeyPrefixSupported() error {
+	if conf.EtcdKeyPrefix == "" {
+		return nil
+	}
+	if err := validateEtcdKeyPrefix(conf.EtcdKeyPrefix); err != nil {
+		return err
+	}
+	if conf.EtcdKeyPrefix != defaultEtcdKeyPrefix {
+		return fmt.Errorf("etcd key prefix '%s' is not supported by the etcd client, which only uses '%s'", conf.EtcdKeyPrefix, defaultEtcdKeyPrefix)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// AnnotationPendingRelease records the tunnel addresses that were removed from a node but not yet released, because
+// the release is deferred by the DeferredRelease configuration. Its value is a JSON object mapping each address to the
+// IPAM handle it was allocated with. The addresses are released in batches by the gc command. The records are lost if
+// the node is deleted first, in which case the addresses are left to the IPAM garbage collection of deleted nodes, as
+// for any other address allocated to the node.
+const AnnotationPendingRelease = "projectcalico.org/tunnel-addr-pending-release"
+
+const (
+	// defaultGCBatchSize is the maximum number of addresses released by the gc command in each batch, if not set.
+	defaultGCBatchSize = 50
+
+	// defaultGCBatchInterval is the time the gc command waits between batches, if not set.
+	defaultGCBatchInterval = time.Second
+)
+
+// pendingRelease is a tunnel address awaiting release by the gc command.
+type pendingRelease struct {
+	Node   string
+	Addr   string
+	Handle string
+
+	// InUse is set if the address is set on the node again, e.g. because it was reused, so must not be released.
+	InUse bool
+}
+
+// pendingReleases returns the addresses awaiting release recorded on the node, mapped to their handles.
+func pendingReleases(node *libapi.Node) map[string]string {
+	pending := map[string]string{}
+	if value := node.Annotations[AnnotationPendingRelease]; value != "" {
+		if err := json.Unmarshal([]byte(value), &pending); err != nil {
+			log.WithError(err).WithField("node", node.Name).Warn("Ignoring invalid pending release annotation")
+			return map[string]string{}
+		}
+	}
+	return pending
+}
+
+// setPendingReleases records the addresses awaiting release on the node, removing the annotation if there are none.
+func setPendingReleases(node *libapi.Node, pending map[string]string) {
+	if len(pending) == 0 {
+		delete(node.Annotations, AnnotationPendingRelease)
+		return
+	}
+	value, _ := json.Marshal(pending)
+	if node.Annotations == nil {
+		node.Annotations = map[string]string{}
+	}
+	node.Annotations[AnnotationPendingRelease] = string(value)
+}
+
+// recordPendingRelease records that the address, allocated with the handle, awaits release on the node. The node must
+// then be updated.
+func recordPendingRelease(node *libapi.Node, addr, handle string) {
+	pending := pendingReleases(node)
+	pending[addr] = handle
+	setPendingReleases(node, pending)
+}
+
+// runGCCommand releases the tunnel addresses awaiting release on all nodes, in batches, for use with DeferredRelease,
+// e.g. from a periodic job. It exits non-zero if the release fails, in which case it may simply be run again.
+func runGCCommand(conf *Config, args []string) int {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", defaultGCBatchSize, "Maximum number of addresses to release in each batch")
+	interval := fs.Duration("interval", defaultGCBatchInterval, "Time to wait between batches")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *batchSize <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid --batch-size %d, must be positive\n", *batchSize)
+		return 1
+	}
+
+	_, c := createClient(conf)
+	ctx, stop := signalContext()
+	defer stop()
+
+	released, err := releasePendingAddrs(withRunID(ctx, newRunID()), c, conf, *batchSize, *interval)
+	fmt.Printf("Released %d tunnel addresses\n", released)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to release the pending tunnel addresses: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// releasePendingAddrs releases the tunnel addresses awaiting release on every node, in batches with a pause between
+// them to limit the load on the datastore, and returns the number released. An address is only released if it is
+// still allocated with the recorded handle and is not set on the node again. Otherwise its record is just removed.
+// The records of each batch are removed once it is released, and the run fails if they cannot be, so a failed run can
+// be repeated.
+func releasePendingAddrs(ctx context.Context, c client.Interface, conf *Config, batchSize int, interval time.Duration) (int, error) {
+	nodes, err := c.Nodes().List(ctx, options.ListOptions{})
+	if err != nil {
+		return 0, ErrDatastoreUnavailable{Operation: "list nodes", Err: err}
+	}
+	var pending []pendingRelease
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		inUse := map[string]bool{}
+		for _, attrType := range tunnelAttrTypes {
+			if addr := getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0]); addr != "" {
+				inUse[addr] = true
+			}
+		}
+		for addr, handle := range pendingReleases(node) {
+			pending = append(pending, pendingRelease{Node: node.Name, Addr: addr, Handle: handle, InUse: inUse[addr]})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		if pending[i].Node != pending[j].Node {
+			return pending[i].Node < pending[j].Node
+		}
+		return pending[i].Addr < pending[j].Addr
+	})
+
+	released := 0
+	for start := 0; start < len(pending); start += batchSize {
+		if start > 0 {
+			if err := sleepCtx(ctx, interval); err != nil {
+				return released, err
+			}
+		}
+		end := start + batchSize
+		if end > len(pending) {
+			end = len(pending)
+		}
+		n, err := releasePendingBatch(ctx, c, pending[start:end])
+		released += n
+		if err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
+
+// releasePendingBatch releases the addresses in the batch that are still ours to release in a single request, and then
+// removes the records of the batch from the nodes. It returns the number of addresses released.
+func releasePendingBatch(ctx context.Context, c client.Interface, batch []pendingRelease) (int, error) {
+	logCtx := getLogger(ctx, "")
+	var ips []net.IP
+	for _, p := range batch {
+		ip := net.ParseIP(p.Addr)
+		if ip == nil || p.InUse {
+			logCtx.WithFields(log.Fields{"node": p.Node, "IP": p.Addr}).Info("Tunnel address is invalid or in use, not releasing it")
+			continue
+		}
+		_, handle, err := c.IPAM().GetAssignmentAttributes(ctx, *ip)
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+			continue
+		} else if err != nil {
+			return 0, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get assignment attributes for '%s'", p.Addr), Err: err}
+		} else if handle == nil || *handle != p.Handle {
+			logCtx.WithFields(log.Fields{"node": p.Node, "IP": p.Addr}).Info("Tunnel address has been reallocated, not releasing it")
+			continue
+		}
+		ips = append(ips, *ip)
+	}
+	if len(ips) > 0 {
+		if err := releaseIPs(ctx, c, ips, logCtx); err != nil {
+			return 0, err
+		}
+		logCtx.WithField("IPs", ips).Info("Released pending tunnel addresses")
+	}
+
+	// Remove the records from the nodes. If they cannot be removed the run fails, since the next run would otherwise
+	// release the addresses again, after they may have been reallocated.
+	byNode := map[string][]string{}
+	for _, p := range batch {
+		byNode[p.Node] = append(byNode[p.Node], p.Addr)
+	}
+	for nodename, addrs := range byNode {
+		if err := removePendingReleases(ctx, c, nodename, addrs); err != nil {
+			return len(ips), err
+		}
+	}
+	return len(ips), nil
+}
+
+// removePendingReleases removes the records of the addresses awaiting release from the node, retrying if the update
+// conflicts. A node that no longer exists has nothing to remove.
+func removePendingReleases(ctx context.Context, c client.Interface, nodename string, addrs []string) error {
+	start := getClock(ctx).Now()
+	var err error
+	for i := 0; i < nodeUpdateAttempts; i++ {
+		var node *libapi.Node
+		node, err = c.Nodes().Get(ctx, nodename, options.GetOptions{})
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+			return nil
+		} else if err != nil {
+			return nodeOperationError("get", nodename, err)
+		}
+		pending := pendingReleases(node)
+		for _, addr := range addrs {
+			delete(pending, addr)
+		}
+		setPendingReleases(node, pending)
+
+		_, err = c.Nodes().Update(ctx, node, options.SetOptions{})
+		if _, ok := err.(cerrors.ErrorResourceUpdateConflict); ok {
+			getLogger(ctx, "").WithField("node", nodename).WithFields(retryFields(ctx, i+1, nodeUpdateAttempts, start)).WithError(err).Info("Error removing pending release records, retrying.")
+			if err := retrySleep(ctx, nodeUpdateRetryInterval, err); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return nodeOperationError("update", nodename, err)
+		}
+		return nil
+	}
+	return ErrUpdateConflictTimeout{Node: nodename, Attempts: nodeUpdateAttempts, Err: err}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"fmt"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// reconcileOrder is the order in which the tunnel address types are reconciled. Wireguard is assigned first, then IPIP
+// and VXLAN.
+var reconcileOrder = []string{ipam.AttributeTypeWireguard, ipam.AttributeTypeIPIP, ipam.AttributeTypeVXLAN}
+
+// tunnelAction is what a reconcile should do with the tunnel address of a single type.
+type tunnelAction string
+
+const (
+	// tunnelActionSkip leaves the tunnel address unchanged, because it is not managed by the allocator.
+	tunnelActionSkip tunnelAction = "Skip"
+
+	// tunnelActionKeep keeps the current tunnel address.
+	tunnelActionKeep tunnelAction = "Keep"
+
+	// tunnelActionAssign assigns a tunnel address from the pools, in place of the current address if there is one.
+	tunnelActionAssign tunnelAction = "Assign"
+
+	// tunnelActionRemove removes and releases the tunnel address, if there is one.
+	tunnelActionRemove tunnelAction = "Remove"
+
+	// tunnelActionVerify only verifies a user-managed tunnel address, which is never released or reassigned.
+	tunnelActionVerify tunnelAction = "Verify"
+
+	// tunnelActionRepair reallocates the current tunnel address with our handle and attributes, after which its
+	// allocation is checked again. If the address has been taken in the meantime, a new one is assigned instead.
+	tunnelActionRepair tunnelAction = "Repair"
+
+	// tunnelActionPreserve leaves a tunnel address that appears to have been set manually in place, with a warning.
+	tunnelActionPreserve tunnelAction = "Preserve"
+)
+
+// desiredState is the desired state of the tunnel address of a single type.
+type desiredState struct {
+	Action tunnelAction
+
+	// Addr is the current tunnel address, if any, in its canonical form if it is valid.
+	Addr string
+
+	// Pools are the pools that the tunnel address must be within, constrained to the tunnel address sub-CIDR if one
+	// is configured.
+	Pools []net.IPNet
+
+	// Reason explains the action, for logging.
+	Reason string
+
+	// Err, if set, is why the tunnel address cannot be managed. It is returned when the plan is executed.
+	Err error
+
+	// Rewrite is set if the address on the node must first be rewritten in its canonical form.
+	Rewrite bool
+
+	// CheckAllocation is set if the plan depends on the IPAM allocation of the current address, and must be refined
+	// by desiredStateOfAllocation before it is executed.
+	CheckAllocation bool
+
+	// CheckHandleAddrs is set if a kept address must be the only address held by our handle.
+	CheckHandleAddrs bool
+
+	// Release is set if the addresses held by our handle must be released when a new address is assigned.
+	Release bool
+
+	// Reassign is set if the new address replaces an address of ours, which counts against the reassignment limits.
+	Reassign bool
+
+	// Warning, if set, is added to the run warnings when the plan is executed.
+	Warning string
+}
+
+// desiredTunnelState returns the desired state of each type of tunnel address of the node, given the pools enabled
+// for each type. It makes no datastore calls, so it is decided from the node and pools alone: where the decision
+// depends on the IPAM allocation of the current address, the plan is refined by desiredStateOfAllocation when it is
+// executed by ensureHostTunnelAddress, and a required reassignment may still be deferred by the reassignment limits.
+func desiredTunnelState(node *libapi.Node, pools poolIndex, conf *Config) map[string]desiredState {
+	states := map[string]desiredState{}
+	for _, attrType := range reconcileOrder {
+		addr := getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0])
+		cidrs := pools[attrType]
+
+		var state desiredState
+		switch {
+		case conf.UnmanagedTunnelAddrTypes[attrType]:
+			state = desiredState{Action: tunnelActionSkip, Reason: "tunnel address management is disabled for this type"}
+		case attrType == ipam.AttributeTypeIPIP && isWindowsNode(node):
+			state = desiredState{Action: tunnelActionSkip, Reason: "IPIP is not supported on Windows nodes"}
+		case len(cidrs) == 0:
+			state = desiredState{Action: tunnelActionRemove, Reason: "no pools are enabled for this type"}
+		case isUserManagedTunnelAddr(node, attrType):
+			state = desiredState{Action: tunnelActionVerify, Pools: cidrs, Reason: "tunnel address is user-managed"}
+		default:
+			state = desiredStateOfAddr(node, addr, cidrs, conf)
+		}
+		if state.Addr == "" {
+			state.Addr = addr
+		}
+		states[attrType] = state
+	}
+	crossCheckEncapsulation(pools, conf, states)
+	return states
+}
+
+// crossCheckEncapsulation plans the removal of a stale IPIP or VXLAN address when the node has both but pools are only
+// enabled for the other type. Usually the stale type is already planned for removal since it has no pools, but it is
+// skipped on a Windows node, which would otherwise keep a stale IPIP address alongside its VXLAN address indefinitely.
+// The removal clears the field even if the address is within the range of some other pool, and only releases it if
+// it is allocated to us, as for any removal.
+func crossCheckEncapsulation(pools poolIndex, conf *Config, states map[string]desiredState) {
+	if states[ipam.AttributeTypeIPIP].Addr == "" || states[ipam.AttributeTypeVXLAN].Addr == "" {
+		return
+	}
+	for stale, enabled := range map[string]string{
+		ipam.AttributeTypeIPIP:  ipam.AttributeTypeVXLAN,
+		ipam.AttributeTypeVXLAN: ipam.AttributeTypeIPIP,
+	} {
+		if len(pools[stale]) > 0 || len(pools[enabled]) == 0 || conf.UnmanagedTunnelAddrTypes[stale] {
+			continue
+		}
+		states[stale] = desiredState{
+			Action: tunnelActionRemove,
+			Addr:   states[stale].Addr,
+			Reason: fmt.Sprintf("no pools are enabled for this type, only for %s", enabled),
+		}
+	}
+}
+
+// desiredStateOfAddr returns whether the node's current tunnel address should be kept or replaced, as far as can be
+// told without its IPAM allocation.
+func desiredStateOfAddr(node *libapi.Node, addr string, cidrs []net.IPNet, conf *Config) desiredState {
+	// If configured, only addresses within the sub-CIDR of the pools are valid.
+	cidrs, err := conf.constrainToSubCIDR(cidrs)
+	if err != nil {
+		return desiredState{Action: tunnelActionAssign, Err: err, Reason: "tunnel address sub-CIDR is not usable"}
+	}
+	if addr == "" {
+		// Defensively release any addresses held by our handle. This covers a theoretical case where the node has
+		// lost its reference to its address, but the allocation still exists in IPAM, e.g. if the node was edited.
+		return desiredState{Action: tunnelActionAssign, Pools: cidrs, Release: true, Reason: "node has no tunnel address"}
+	}
+	normalized, err := normalizeTunnelAddr(addr)
+	if err != nil {
+		return desiredState{Action: tunnelActionAssign, Err: ErrInvalidTunnelAddress{Addr: addr, Err: err}, Reason: "tunnel address is invalid"}
+	}
+
+	// An address with a CIDR suffix is rewritten as a bare IP if it is to be kept, and replaced otherwise.
+	inPool := isIpInPool(normalized, cidrs)
+	state := desiredState{Addr: normalized, Pools: cidrs, Rewrite: normalized != addr && inPool, CheckAllocation: true}
+	switch {
+	case inPool && conf.SkipTunnelAddrOwnershipCheck:
+		state.Action, state.CheckAllocation = tunnelActionKeep, false
+		state.Reason = "tunnel address is in an enabled pool, and the ownership check is disabled"
+	case inPool:
+		state.Action, state.Reason = tunnelActionKeep, "tunnel address is in an enabled pool"
+	case conf.StickyTunnelAddrs:
+		state.Action, state.Reason = tunnelActionKeep, "tunnel address is not in an enabled pool, but sticky tunnel addresses are enabled"
+	case isManualReassignment(conf, node):
+		state.Action, state.Reason = tunnelActionKeep, "tunnel address is not in an enabled pool, but reassignment is disabled by policy"
+	default:
+		state.Action, state.Reason = tunnelActionAssign, "tunnel address is not in an enabled pool"
+	}
+	return state
+}
+
+// tunnelAllocation is the IPAM allocation of a tunnel address.
+type tunnelAllocation struct {
+	// Exists is false if the address is not allocated in IPAM, in which case it has no attributes or handle.
+	Exists bool
+	Attrs  map[string]string
+	Handle *string
+}
+
+// desiredStateOfAllocation refines the desired state of the node's current tunnel address according to its IPAM
+// allocation: whether it is ours to keep, is ours but must be repaired or replaced, or belongs to something else. Like
+// desiredTunnelState, it makes no datastore calls.
+func desiredStateOfAllocation(node *libapi.Node, state desiredState, alloc tunnelAllocation, conf *Config, attrType string) desiredState {
+	addr, attrs := state.Addr, alloc.Attrs
+	next := desiredState{Addr: addr, Pools: state.Pools}
+	foreign := conf.PreserveForeignTunnelAddrs && !isIpInPool(addr, state.Pools)
+
+	switch {
+	case !alloc.Exists && foreign:
+		next.Action, next.Reason = tunnelActionPreserve, "tunnel address is outside the pools and not allocated in IPAM"
+	case !alloc.Exists:
+		// Defensively release any addresses held by our handle, as for a node with no tunnel address.
+		next.Action, next.Release, next.Reason = tunnelActionAssign, true, "tunnel address is not allocated in IPAM"
+	case attrs[ipam.AttributeType] == attrType && attrs[ipam.AttributeNode] == node.Name:
+		// The address is still allocated to this node, but is it in the correct pool? We only manage IPv4 tunnel
+		// addresses here, so only the IPv4 result is relevant.
+		v4Valid, _ := isIpInPoolByFamily(addr, "", state.Pools)
+		ourHandle, _ := generateHandleAndAttributes(node.Name, attrType)
+		switch {
+		case !v4Valid && conf.StickyTunnelAddrs:
+			next.Action, next.Reason = tunnelActionKeep, "tunnel address is not in a valid pool, but sticky tunnel addresses are enabled"
+			next.Warning = fmt.Sprintf("address %s is not in a valid pool", addr)
+		case !v4Valid && isManualReassignment(conf, node):
+			// Reassignment must be done manually, so that the operator controls when routes change. Only warn until
+			// the operator allows it by removing the annotation.
+			next.Action, next.Reason = tunnelActionKeep, "tunnel address is not in a valid pool, reassignment required but disabled by policy"
+			next.Warning = fmt.Sprintf("reassignment of address %s required but disabled by policy", addr)
+		case !v4Valid:
+			next.Action, next.Reason = tunnelActionAssign, "tunnel address is not in a valid pool"
+			next.Release, next.Reassign = true, true
+		case alloc.Handle == nil || *alloc.Handle != ourHandle:
+			// E.g. after the IPAM data was restored from a backup. Without our handle the address would never be
+			// released.
+			next.Action, next.Reason = tunnelActionRepair, "tunnel address is not allocated with our handle"
+		default:
+			next.Action, next.CheckHandleAddrs, next.Reason = tunnelActionKeep, true, "tunnel address is still valid"
+		}
+	case attrs[ipam.AttributeNode] == node.Name && IsTunnelAddress(attrs) &&
+		getTunnelAddrField(node, conf.tunnelAddrFields(attrs[ipam.AttributeType])[0]) != addr:
+		// The address is allocated as one of this node's tunnel addresses, but of another type that is not using it,
+		// e.g. a VXLAN address allocated under the IPIP attribute. Felix relies on the attribute type, and the
+		// allocation would be released along with the other type's handle.
+		next.Action = tunnelActionRepair
+		next.Reason = fmt.Sprintf("tunnel address is allocated as a %s tunnel address", attrs[ipam.AttributeType])
+	case len(attrs) == 0:
+		// No attributes means that this is an old address, assigned by code that didn't use allocation attributes.
+		// It might be a pod address, or it might be a node tunnel address. The only way to tell is by the existence
+		// of a handle, since workload addresses have always used a handle, whereas tunnel addresses didn't start
+		// using handles until the same time as they got allocation attributes.
+		switch {
+		case alloc.Handle != nil && foreign:
+			next.Action, next.Reason = tunnelActionPreserve, "tunnel address is outside the pools and allocated to something else"
+		case alloc.Handle != nil:
+			// The address belongs to a workload, so assign a new one but don't release the old address.
+			next.Action, next.Reason = tunnelActionAssign, "tunnel address is allocated to a workload"
+		default:
+			// An old tunnel address from before we used handles. Reallocate the same address, but now with metadata.
+			next.Action, next.Reason = tunnelActionRepair, "tunnel address is allocated without a handle or attributes"
+		}
+	case foreign:
+		next.Action, next.Reason = tunnelActionPreserve, "tunnel address is outside the pools and allocated to something else"
+	default:
+		next.Action, next.Reason = tunnelActionAssign, "tunnel address is allocated to something else"
+	}
+	return next
+}
+
+// plannedTypes returns the types of tunnel address that are not skipped by the plan, in reconcile order.
+func plannedTypes(states map[string]desiredState) []string {
+	var attrTypes []string
+	for _, attrType := range reconcileOrder {
+		if states[attrType].Action != tunnelActionSkip {
+			attrTypes = append(attrTypes, attrType)
+		}
+	}
+	return attrTypes
+}
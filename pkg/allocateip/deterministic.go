@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"hash/fnv"
+	"math/big"
+	gnet "net"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	log "github.com/sirupsen/logrus"
+)
+
+// AssignmentStrategy determines how the address within the chosen pools is picked when assigning a tunnel address.
+type AssignmentStrategy string
+
+const (
+	// AssignmentAuto lets IPAM pick the first free address, as for any other allocation. This is the default.
+	AssignmentAuto AssignmentStrategy = "auto"
+
+	// AssignmentDeterministic picks the address from a hash of the node name, so that a node is given the same
+	// address each time it is assigned one from the same pools. This is only best-effort:
+	//
+	//   - If the candidate address is already allocated, e.g. because two node names hash to the same address, or
+	//     cannot be assigned for any other reason, the address is assigned by IPAM as for AssignmentAuto.
+	//   - The candidate depends on the pool CIDR, so resizing or replacing a pool changes the address of each node.
+	//   - The candidate is not checked against IP reservations or block affinities, so it may be carved from a block
+	//     that is affine to another node.
+	AssignmentDeterministic AssignmentStrategy = "deterministic"
+)
+
+// assignDeterministicAddr attempts to assign the deterministic candidate address for the node from each of the pools
+// in turn, under the supplied IPAM host, returning the assignment, or nil if none of the candidates could be assigned.
+func assignDeterministicAddr(ctx context.Context, c client.Interface, nodename, host string, pools []net.IPNet, handle string, attrs map[string]string, logCtx *log.Entry) *ipam.IPAMAssignments {
+	for _, pool := range pools {
+		if pool.Version() != 4 {
+			continue
+		}
+		ip := deterministicTunnelAddr(nodename, pool)
+		args := ipam.AssignIPArgs{
+			IP:       ip,
+			HandleID: &handle,
+			Attrs:    attrs,
+			Hostname: host,
+		}
+		if err := c.IPAM().AssignIP(ctx, args); err != nil {
+			logCtx.WithError(err).WithField("IP", ip).Info("Unable to assign deterministic tunnel address")
+			continue
+		}
+		return &ipam.IPAMAssignments{
+			IPs:          []net.IPNet{{IPNet: gnet.IPNet{IP: ip.IP, Mask: gnet.CIDRMask(32, 32)}}},
+			IPVersion:    4,
+			NumRequested: 1,
+		}
+	}
+	logCtx.Info("No deterministic tunnel address available, falling back to automatic assignment")
+	return nil
+}
+
+// deterministicTunnelAddr returns the candidate tunnel address for the node within the pool, computed by hashing the
+// node name into the range of the pool.
+func deterministicTunnelAddr(nodename string, pool net.IPNet) net.IP {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(nodename))
+
+	ones, bits := pool.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	offset := new(big.Int).Mod(new(big.Int).SetUint64(h.Sum64()), size)
+	return net.IncrementIP(net.IP{IP: pool.IP.Mask(pool.Mask)}, offset)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// tunnelAddrClaim is a node's claim to a tunnel address of a particular type.
+type tunnelAddrClaim struct {
+	Node string
+	Type string
+}
+
+// findDuplicateTunnelAddrs returns the tunnel addresses that are claimed more than once across the supplied nodes,
+// mapped to the claims in node order. An address may be claimed twice by the same node, as different tunnel types.
+func findDuplicateTunnelAddrs(conf *Config, nodes []libapi.Node) map[string][]tunnelAddrClaim {
+	claims := map[string][]tunnelAddrClaim{}
+	for i := range nodes {
+		for _, attrType := range tunnelAttrTypes {
+			if addr := getTunnelAddrField(&nodes[i], conf.tunnelAddrFields(attrType)[0]); addr != "" {
+				claims[addr] = append(claims[addr], tunnelAddrClaim{Node: nodes[i].Name, Type: attrType})
+			}
+		}
+	}
+	for addr, c := range claims {
+		if len(c) < 2 {
+			delete(claims, addr)
+		}
+	}
+	return claims
+}
+
+// duplicateRemoval is the removal of a duplicated tunnel address from one of a node's claims to it.
+type duplicateRemoval struct {
+	Addr string
+	Type string
+}
+
+// checkDuplicateTunnelAddrs lists all nodes and logs an error for each tunnel address that is claimed more than once,
+// returning the number of duplicated addresses. If resolve is set, the address is kept by the claim that IPAM has it
+// allocated to, or by the first claim if IPAM has it allocated to none of them, and is removed from the other claims so
+// that those nodes are assigned new addresses. If onlyNode is set, only the claims of that node are removed. The IPAM
+// lookups and node updates made to resolve the duplicates are bounded by the sweep limits.
+//
+// The duplicates are removed from the nodes in order of node name, skipping the nodes up to and including startAfter
+// if it is set. The last node returned is the last node in that order up to which the removals were all completed, or
+// startAfter if there were none, so that an interrupted sweep can be resumed after it.
+func checkDuplicateTunnelAddrs(ctx context.Context, c client.Interface, conf *Config, resolve bool, onlyNode string, limits sweepLimits, startAfter string) (n int, lastNode string, err error) {
+	// The nodes are listed in a single request, since the libcalico-go list options have no limit or continue token to
+	// page through them with. Duplicates can only be found by comparing every node anyway.
+	nodeList, err := c.Nodes().List(ctx, options.ListOptions{})
+	if err != nil {
+		return 0, startAfter, ErrDatastoreUnavailable{Operation: "list nodes", Err: err}
+	}
+
+	duplicates := findDuplicateTunnelAddrs(conf, nodeList.Items)
+	gaugeDuplicateTunnelAddrs.Set(float64(len(duplicates)))
+	for addr, claims := range duplicates {
+		getLogger(ctx, "").WithFields(log.Fields{"IP": addr, "claims": claims}).Error("Tunnel address is claimed by more than one node or tunnel type, overlay connectivity may be broken")
+	}
+	if !resolve {
+		return len(duplicates), startAfter, nil
+	}
+
+	// Only the claims of the nodes still to be swept may be removed.
+	removable := func(nodename string) bool {
+		return nodename > startAfter && (onlyNode == "" || nodename == onlyNode)
+	}
+	var addrs []string
+	for addr, claims := range duplicates {
+		for _, claim := range claims {
+			if removable(claim.Node) {
+				addrs = append(addrs, addr)
+				break
+			}
+		}
+	}
+	sort.Strings(addrs)
+
+	// Work out which claim keeps each address, then remove the address from the other claims node by node.
+	throttle := newSweepThrottle(limits.MaxQPS)
+	var lock sync.Mutex
+	removals := map[string][]duplicateRemoval{}
+	if _, err := sweepBatches(ctx, limits, throttle, addrs, func(ctx context.Context, throttle *sweepThrottle, addr string) error {
+		keep, err := duplicateKeeper(ctx, c, throttle, addr, duplicates[addr])
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		for i, claim := range duplicates[addr] {
+			if i != keep && removable(claim.Node) {
+				removals[claim.Node] = append(removals[claim.Node], duplicateRemoval{Addr: addr, Type: claim.Type})
+			}
+		}
+		return nil
+	}); err != nil {
+		return len(duplicates), startAfter, err
+	}
+
+	nodes := make([]string, 0, len(removals))
+	for nodename := range removals {
+		nodes = append(nodes, nodename)
+		rs := removals[nodename]
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Addr < rs[j].Addr })
+	}
+	sort.Strings(nodes)
+	completed, err := sweepBatches(ctx, limits, throttle, nodes, func(ctx context.Context, throttle *sweepThrottle, nodename string) error {
+		for _, r := range removals[nodename] {
+			getLogger(ctx, "").WithFields(log.Fields{"IP": r.Addr, "node": nodename, "type": r.Type}).Warn("Removing duplicate tunnel address from node")
+			if err := clearTunnelAddr(ctx, c, conf, throttle, nodename, r.Addr, r.Type); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if lastNode = startAfter; completed > 0 {
+		lastNode = nodes[completed-1]
+	}
+	return len(duplicates), lastNode, err
+}
+
+// duplicateKeeper returns the index of the claim that keeps the duplicated address, as described by
+// checkDuplicateTunnelAddrs, waiting on the throttle before each datastore request.
+func duplicateKeeper(ctx context.Context, c client.Interface, throttle *sweepThrottle, addr string, claims []tunnelAddrClaim) (int, error) {
+	for i, claim := range claims {
+		if err := throttle.wait(ctx); err != nil {
+			return 0, err
+		}
+		allocated, err := isTunnelAddrAllocated(ctx, c, claim.Node, addr, claim.Type)
+		if err != nil {
+			return 0, err
+		} else if allocated {
+			return i, nil
+		}
+	}
+	return 0, nil
+}
+
+// clearTunnelAddr removes the tunnel address of the specified type from the node, provided it is still set to addr.
+// Unlike removeHostTunnelAddr the address is not released, since it is in use by another node. The node's allocator
+// will then assign it a new address.
+func clearTunnelAddr(ctx context.Context, c client.Interface, conf *Config, throttle *sweepThrottle, nodename, addr, attrType string) error {
+	if err := throttle.wait(ctx); err != nil {
+		return err
+	}
+	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		return nodeOperationError("get", nodename, err)
+	}
+	fields := conf.tunnelAddrFields(attrType)
+	if getTunnelAddrField(node, fields[0]) != addr {
+		// The address has changed since we listed the nodes.
+		return nil
+	}
+	for _, field := range fields {
+		setTunnelAddrField(node, field, "")
+	}
+	if err := throttle.wait(ctx); err != nil {
+		return err
+	}
+	if _, err := c.Nodes().Update(ctx, node, options.SetOptions{}); err != nil {
+		return nodeOperationError("update", nodename, err)
+	}
+	auditTunnelAddrChange(ctx, conf, nodename, attrType, addr, "", AuditReasonDuplicate)
+	return nil
+}
+
+// runDuplicatesCommand reports the tunnel addresses that are claimed more than once across the cluster, optionally
+// resolving them. It exits non-zero if duplicates were found and not resolved.
+func runDuplicatesCommand(conf *Config, args []string) int {
+	fs := flag.NewFlagSet("duplicates", flag.ContinueOnError)
+	resolve := fs.Bool("resolve", false, "Remove duplicate tunnel addresses so that the affected nodes are assigned new ones")
+	var limits sweepLimits
+	fs.IntVar(&limits.Concurrency, "concurrency", 1, "Maximum number of duplicate tunnel addresses or nodes to resolve at once")
+	fs.Float64Var(&limits.MaxQPS, "max-qps", 0, "Maximum rate of datastore requests made to resolve duplicates, 0 for no limit")
+	fs.IntVar(&limits.BatchSize, "batch-size", 100, "Number of nodes to resolve duplicates on in each batch, 0 for a single batch")
+	startAfter := fs.String("start-after", "", "Only resolve duplicates on the nodes named after this one, to resume an interrupted run")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if err := limits.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid limits: %v\n", err)
+		return 1
+	}
+
+	_, c := createClient(conf)
+	n, lastNode, err := checkDuplicateTunnelAddrs(context.Background(), c, conf, *resolve, "", limits, *startAfter)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to check for duplicate tunnel addresses: %v\n", err)
+		if *resolve && lastNode != "" {
+			fmt.Fprintf(os.Stderr, "Resume with --start-after %s\n", lastNode)
+		}
+		return 1
+	}
+	fmt.Printf("Found %d duplicate tunnel addresses\n", n)
+	if *resolve && lastNode != "" {
+		fmt.Printf("Last node completed: %s\n", lastNode)
+	}
+	if n > 0 && !*resolve {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build e2e
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	"github.com/projectcalico/libcalico-go/lib/apiconfig"
+	"github.com/projectcalico/libcalico-go/lib/backend"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// The end-to-end tests run the allocator through Run() against the real libcalico-go IPAM and an etcd datastore. They
+// are only built with the e2e build tag. If ETCD_ENDPOINTS is not set, an etcd container is started for the tests.
+
+const (
+	e2eEtcdContainer = "calico-allocateip-e2e-etcd"
+	e2eEtcdImage     = "quay.io/coreos/etcd:v3.4.13"
+	e2eEtcdEndpoint  = "http://127.0.0.1:2379"
+	e2eNodeName      = "e2e.node"
+)
+
+var e2eStartedEtcd bool
+
+var _ = BeforeSuite(func() {
+	if os.Getenv("ETCD_ENDPOINTS") != "" {
+		return
+	}
+
+	image := os.Getenv("E2E_ETCD_IMAGE")
+	if image == "" {
+		image = e2eEtcdImage
+	}
+
+	By("starting an etcd container")
+	_ = exec.Command("docker", "rm", "-f", e2eEtcdContainer).Run()
+	out, err := exec.Command("docker", "run", "--detach", "--net=host", "--name", e2eEtcdContainer, image,
+		"etcd", "--advertise-client-urls", e2eEtcdEndpoint, "--listen-client-urls", e2eEtcdEndpoint).CombinedOutput()
+	Expect(err).NotTo(HaveOccurred(), string(out))
+	e2eStartedEtcd = true
+
+	Expect(os.Setenv("DATASTORE_TYPE", "etcdv3")).To(Succeed())
+	Expect(os.Setenv("ETCD_ENDPOINTS", e2eEtcdEndpoint)).To(Succeed())
+
+	// Wait for etcd to accept requests.
+	cfg, err := apiconfig.LoadClientConfigFromEnvironment()
+	Expect(err).NotTo(HaveOccurred())
+	Eventually(func() error {
+		be, err := backend.NewClient(*cfg)
+		if err != nil {
+			return err
+		}
+		return be.Clean()
+	}, "30s", "500ms").ShouldNot(HaveOccurred())
+})
+
+var _ = AfterSuite(func() {
+	if e2eStartedEtcd {
+		_ = exec.Command("docker", "rm", "-f", e2eEtcdContainer).Run()
+	}
+})
+
+var _ = Describe("e2e: tunnel address allocation", func() {
+	ctx := context.Background()
+
+	var c client.Interface
+	BeforeEach(func() {
+		cfg, err := apiconfig.LoadClientConfigFromEnvironment()
+		Expect(err).NotTo(HaveOccurred())
+
+		// Clear out datastore
+		be, err := backend.NewClient(*cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(be.Clean()).To(Succeed())
+
+		c, err = client.New(*cfg)
+		Expect(err).NotTo(HaveOccurred())
+
+		node := makeNode("192.168.0.1/24", "")
+		node.Name = e2eNodeName
+		_, err = c.Nodes().Create(ctx, node, options.SetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.Setenv("NODENAME", e2eNodeName)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(os.Unsetenv("NODENAME")).To(Succeed())
+	})
+
+	// runOnce runs the allocator in single-shot mode, with the configuration from the environment.
+	runOnce := func() {
+		Run(LoadConfig(), nil)
+	}
+
+	// getAddr returns the tunnel address of the specified type from the node spec.
+	getAddr := func(attrType string) string {
+		node, err := c.Nodes().Get(ctx, e2eNodeName, options.GetOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		return getTunnelAddrField(node, defaultTunnelAddrFields[attrType])
+	}
+
+	// expectAllocated asserts that IPAM holds exactly the address for the node's tunnel handle of the specified type.
+	expectAllocated := func(attrType, addr string) {
+		handle, _ := generateHandleAndAttributes(e2eNodeName, attrType)
+		ips, err := c.IPAM().IPsByHandle(ctx, handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].String()).To(Equal(addr))
+
+		attrs, _, err := c.IPAM().GetAssignmentAttributes(ctx, *net.ParseIP(addr))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(HaveKeyWithValue(ipam.AttributeNode, e2eNodeName))
+		Expect(attrs).To(HaveKeyWithValue(ipam.AttributeType, attrType))
+	}
+
+	// expectNotAllocated asserts that IPAM holds no addresses for the node's tunnel handle of the specified type.
+	expectNotAllocated := func(attrType string) {
+		handle, _ := generateHandleAndAttributes(e2eNodeName, attrType)
+		ips, err := c.IPAM().IPsByHandle(ctx, handle)
+		if err == nil {
+			Expect(ips).To(BeEmpty())
+		}
+	}
+
+	for _, mode := range []string{ipam.AttributeTypeIPIP, ipam.AttributeTypeVXLAN} {
+		attrType := mode
+
+		// makePool returns a pool with encapsulation of the type under test.
+		makePool := func(name, cidr string) *api.IPPool {
+			pool := makeIPv4Pool(name, cidr, 26)
+			if attrType == ipam.AttributeTypeVXLAN {
+				pool.Spec.IPIPMode = api.IPIPModeNever
+				pool.Spec.VXLANMode = api.VXLANModeAlways
+			}
+			return pool
+		}
+
+		It(fmt.Sprintf("should assign, keep, reassign and remove the %s address", attrType), func() {
+			By("assigning an address from the enabled pool")
+			pool1, err := c.IPPools().Create(ctx, makePool("pool1", "172.16.0.0/24"), options.SetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			runOnce()
+			addr := getAddr(attrType)
+			_, pool1Net, _ := net.ParseCIDR("172.16.0.0/24")
+			Expect(pool1Net.Contains(net.ParseIP(addr).IP)).To(BeTrue(), addr)
+			expectAllocated(attrType, addr)
+
+			By("keeping the address on a subsequent run")
+			runOnce()
+			Expect(getAddr(attrType)).To(Equal(addr))
+			expectAllocated(attrType, addr)
+
+			By("reassigning the address when the pool changes")
+			_, err = c.IPPools().Create(ctx, makePool("pool2", "172.17.0.0/24"), options.SetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			pool1.Spec.Disabled = true
+			pool1, err = c.IPPools().Update(ctx, pool1, options.SetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			runOnce()
+			newAddr := getAddr(attrType)
+			_, pool2Net, _ := net.ParseCIDR("172.17.0.0/24")
+			Expect(pool2Net.Contains(net.ParseIP(newAddr).IP)).To(BeTrue(), newAddr)
+			expectAllocated(attrType, newAddr)
+			_, _, err = c.IPAM().GetAssignmentAttributes(ctx, *net.ParseIP(addr))
+			Expect(err).To(HaveOccurred(), "old address should have been released")
+
+			By("removing the address when the pool is disabled")
+			pool2, err := c.IPPools().Get(ctx, "pool2", options.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			pool2.Spec.Disabled = true
+			_, err = c.IPPools().Update(ctx, pool2, options.SetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			runOnce()
+			Expect(getAddr(attrType)).To(BeEmpty())
+			expectNotAllocated(attrType)
+		})
+	}
+})
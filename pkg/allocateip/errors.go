@@ -0,0 +1,280 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// The errors returned by the tunnel address allocator. Where there is an underlying cause it is wrapped, and may be
+// retrieved with errors.Unwrap. The error types themselves may be matched with errors.As.
+
+// ErrPoolExhausted is returned when a tunnel address could not be assigned because there are no free addresses in
+// the enabled IP pools.
+type ErrPoolExhausted struct {
+	Err error
+}
+
+func (e ErrPoolExhausted) Error() string {
+	return fmt.Sprintf("no free addresses in the enabled IP pools: %v", e.Err)
+}
+
+func (e ErrPoolExhausted) Unwrap() error {
+	return e.Err
+}
+
+// ErrDatastoreUnavailable is returned when a datastore operation fails for a reason other than a conflict.
+type ErrDatastoreUnavailable struct {
+	Operation string
+	Err       error
+}
+
+func (e ErrDatastoreUnavailable) Error() string {
+	return fmt.Sprintf("datastore error during %s: %v", e.Operation, e.Err)
+}
+
+func (e ErrDatastoreUnavailable) Unwrap() error {
+	return e.Err
+}
+
+// ErrUpdateConflictTimeout is returned when the node could not be updated because every attempt failed with an
+// update conflict.
+type ErrUpdateConflictTimeout struct {
+	Node     string
+	Attempts int
+	Err      error
+}
+
+func (e ErrUpdateConflictTimeout) Error() string {
+	return fmt.Sprintf("too many conflicts updating node '%s' after %d attempts: %v", e.Node, e.Attempts, e.Err)
+}
+
+func (e ErrUpdateConflictTimeout) Unwrap() error {
+	return e.Err
+}
+
+// ErrInvalidTunnelAddress is returned when a tunnel address is not a valid IP address.
+type ErrInvalidTunnelAddress struct {
+	Addr string
+	Err  error
+}
+
+func (e ErrInvalidTunnelAddress) Error() string {
+	return fmt.Sprintf("invalid tunnel address '%s': %v", e.Addr, e.Err)
+}
+
+func (e ErrInvalidTunnelAddress) Unwrap() error {
+	return e.Err
+}
+
+// ErrAddressNotInPool is returned when IPAM assigns a tunnel address that is not within any of the requested pools, or
+// when a tunnel address about to be written to the node is not within any of the enabled pools.
+type ErrAddressNotInPool struct {
+	Addr  string
+	Pools []net.IPNet
+}
+
+func (e ErrAddressNotInPool) Error() string {
+	return fmt.Sprintf("tunnel address '%s' is not within the requested pools %v", e.Addr, e.Pools)
+}
+
+// ErrAddressFamilyMismatch is returned when IPAM assigns a tunnel address of a different address family to the one
+// requested, or when such an address is about to be written to the node, since it cannot be stored in the node's IPv4
+// tunnel address fields.
+type ErrAddressFamilyMismatch struct {
+	Addr      string
+	Requested int
+}
+
+func (e ErrAddressFamilyMismatch) Error() string {
+	return fmt.Sprintf("tunnel address '%s' is not an IPv%d address", e.Addr, e.Requested)
+}
+
+// ErrExtraHandleAddrs is returned when the handle of a tunnel address holds addresses other than the one set on the
+// node, and the allocator is configured to leave them for manual intervention rather than release them.
+type ErrExtraHandleAddrs struct {
+	Handle string
+	Addr   string
+	Extras []net.IP
+}
+
+func (e ErrExtraHandleAddrs) Error() string {
+	return fmt.Sprintf("handle '%s' holds addresses %v in addition to the tunnel address '%s'", e.Handle, e.Extras, e.Addr)
+}
+
+// ErrPartialAssignment is returned when IPAM assigns fewer tunnel addresses than were requested.
+type ErrPartialAssignment struct {
+	Requested int
+	Granted   int
+}
+
+func (e ErrPartialAssignment) Error() string {
+	return fmt.Sprintf("requested %d tunnel addresses but only %d were assigned", e.Requested, e.Granted)
+}
+
+// ErrNodeNotReady is returned when tunnel address assignment was skipped because the node is not yet ready.
+type ErrNodeNotReady struct {
+	Node string
+}
+
+func (e ErrNodeNotReady) Error() string {
+	return fmt.Sprintf("node '%s' is not ready", e.Node)
+}
+
+// ErrIncompatibleBlockSize is returned when a tunnel block size is configured but none of the enabled pools has that
+// block size.
+type ErrIncompatibleBlockSize struct {
+	BlockSize int
+	Pools     []net.IPNet
+}
+
+func (e ErrIncompatibleBlockSize) Error() string {
+	return fmt.Sprintf("none of the enabled IP pools %v has the requested tunnel block size /%d", e.Pools, e.BlockSize)
+}
+
+// ErrStrictAffinity is returned in place of ErrPoolExhausted when IPAM strict affinity is enabled. The node has no free
+// addresses in its affine blocks and could not claim a new block, and strict affinity prevents it from borrowing an
+// address from another node's block, even though the pools may have free addresses.
+type ErrStrictAffinity struct {
+	Node             string
+	MaxBlocksPerHost int
+	Err              error
+}
+
+func (e ErrStrictAffinity) Error() string {
+	limit := ""
+	if e.MaxBlocksPerHost > 0 {
+		limit = fmt.Sprintf(" (limited to %d blocks per host)", e.MaxBlocksPerHost)
+	}
+	return fmt.Sprintf("node '%s' has no free addresses in its affine blocks and could not claim a new block%s, "+
+		"and IPAM strict affinity prevents borrowing from other nodes' blocks: %v", e.Node, limit, e.Err)
+}
+
+func (e ErrStrictAffinity) Unwrap() error {
+	return e.Err
+}
+
+// ErrAddressesReserved is returned in place of ErrPoolExhausted when every address in the enabled pools is covered by
+// an IP reservation.
+type ErrAddressesReserved struct {
+	Pools []net.IPNet
+	Err   error
+}
+
+func (e ErrAddressesReserved) Error() string {
+	return fmt.Sprintf("all addresses in the enabled IP pools %v are reserved by IP reservations: %v", e.Pools, e.Err)
+}
+
+func (e ErrAddressesReserved) Unwrap() error {
+	return e.Err
+}
+
+// ErrRetryBudgetExhausted is returned when an operation could not be retried because the retries of the reconcile
+// have used up the configured retry budget.
+type ErrRetryBudgetExhausted struct {
+	Budget time.Duration
+	Err    error
+}
+
+func (e ErrRetryBudgetExhausted) Error() string {
+	return fmt.Sprintf("retry budget of %s exhausted: %v", e.Budget, e.Err)
+}
+
+func (e ErrRetryBudgetExhausted) Unwrap() error {
+	return e.Err
+}
+
+// ErrMixedEncapPools is returned by the strict pool validation when pools are enabled for both IPIP and VXLAN
+// encapsulation.
+type ErrMixedEncapPools struct {
+	Pools []string
+}
+
+func (e ErrMixedEncapPools) Error() string {
+	return fmt.Sprintf("IP pools %v are enabled for both IPIP and VXLAN encapsulation", e.Pools)
+}
+
+// ErrPermissionDenied is returned when the datastore rejects an operation because the allocator's credentials do not
+// permit it, e.g. when the service account's RBAC role does not grant the verb on the resource. Retrying will not
+// help, so the operation is not retried.
+type ErrPermissionDenied struct {
+	Verb     string
+	Resource string
+	Err      error
+}
+
+func (e ErrPermissionDenied) Error() string {
+	return fmt.Sprintf("permission denied to %s %s, check that the role of the allocator's service account grants the %q verb on the %q resource: %v",
+		e.Verb, e.Resource, e.Verb, e.Resource, e.Err)
+}
+
+func (e ErrPermissionDenied) Unwrap() error {
+	return e.Err
+}
+
+// ErrNodeNotFound is returned when the node does not exist, e.g. because it was deleted during reconciliation. There
+// is then nothing to do, and any address assigned to the node during the reconciliation is released.
+type ErrNodeNotFound struct {
+	Node string
+	Err  error
+}
+
+func (e ErrNodeNotFound) Error() string {
+	return fmt.Sprintf("node '%s' does not exist: %v", e.Node, e.Err)
+}
+
+func (e ErrNodeNotFound) Unwrap() error {
+	return e.Err
+}
+
+// ErrNodeLocked is returned when another invocation of the allocator for the same node held the node lock for longer
+// than the lock timeout.
+type ErrNodeLocked struct {
+	Node    string
+	Path    string
+	Timeout time.Duration
+}
+
+func (e ErrNodeLocked) Error() string {
+	return fmt.Sprintf("node '%s' is locked by another invocation, lock file %s not released within %s", e.Node, e.Path, e.Timeout)
+}
+
+// ErrSubCIDRNotInPool is returned when the configured tunnel address sub-CIDR is not within any of the pools that the
+// tunnel address may be assigned from.
+type ErrSubCIDRNotInPool struct {
+	SubCIDR string
+	Pools   []net.IPNet
+}
+
+func (e ErrSubCIDRNotInPool) Error() string {
+	return fmt.Sprintf("tunnel address sub-CIDR %s is not within any of the enabled pools %v", e.SubCIDR, e.Pools)
+}
+
+// ErrInvalidConfig is returned when the configuration has problems, i.e. settings that do not make sense together.
+type ErrInvalidConfig struct {
+	Problems []error
+}
+
+func (e ErrInvalidConfig) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Error()
+	}
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(problems, "; "))
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultExhaustionRetries is the number of times assignment is retried after invoking the exhaustion hook, if not
+	// configured.
+	defaultExhaustionRetries = 3
+
+	// exhaustionRetryInterval is the delay after invoking the exhaustion hook before assignment is retried, giving the
+	// external controller time to add capacity.
+	exhaustionRetryInterval = 5 * time.Second
+
+	// exhaustionHookTimeout is the time allowed for the exhaustion hook to complete.
+	exhaustionHookTimeout = 30 * time.Second
+)
+
+// exhaustionEvent is the JSON body posted to an exhaustion webhook.
+type exhaustionEvent struct {
+	Node       string   `json:"node"`
+	TunnelType string   `json:"tunnelType"`
+	Pools      []string `json:"pools"`
+}
+
+// exhaustionRetries returns the number of times assignment is retried after invoking the exhaustion hook.
+func (conf *Config) exhaustionRetries() int {
+	if conf.ExhaustionRetries == 0 {
+		return defaultExhaustionRetries
+	}
+	return conf.ExhaustionRetries
+}
+
+// autoAssign assigns a tunnel address using AutoAssign. If no address is assigned because the pools are exhausted and
+// an exhaustion hook is configured, the hook is invoked and the assignment retried, so that any capacity added in
+// response is picked up. The result of the last attempt is returned, for the caller to handle any exhaustion.
+func autoAssign(ctx context.Context, c client.Interface, conf *Config, args ipam.AutoAssignArgs, attrType string, logCtx *log.Entry) (*ipam.IPAMAssignments, error) {
+	for attempt := 0; ; attempt++ {
+		v4Assignments, _, err := c.IPAM().AutoAssign(ctx, args)
+		if err != nil || len(v4Assignments.IPs) > 0 || conf.ExhaustionHook == "" || attempt >= conf.exhaustionRetries() {
+			return v4Assignments, err
+		}
+
+		pools := poolNames(ctx, c, args.IPv4Pools)
+		logCtx.WithField("pools", pools).Info("Tunnel address pools are exhausted, invoking the exhaustion hook")
+		if err := runExhaustionHook(ctx, conf.ExhaustionHook, exhaustionEvent{Node: args.Attrs[ipam.AttributeNode], TunnelType: attrType, Pools: pools}); err != nil {
+			logCtx.WithError(err).Warn("Exhaustion hook failed")
+		}
+		if err := retrySleep(ctx, exhaustionRetryInterval, nil); errors.As(err, &ErrRetryBudgetExhausted{}) {
+			logCtx.WithError(err).Info("Not retrying tunnel address assignment after the exhaustion hook")
+			return v4Assignments, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// runExhaustionHook invokes the exhaustion hook for the event. A hook with an http or https scheme is a webhook, to
+// which the event is posted as JSON. Otherwise it is the path of a command, which is run with the tunnel type and the
+// names of the exhausted pools as its arguments.
+func runExhaustionHook(ctx context.Context, hook string, event exhaustionEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, exhaustionHookTimeout)
+	defer cancel()
+
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("webhook returned status %s", resp.Status)
+		}
+		return nil
+	}
+
+	out, err := exec.CommandContext(ctx, hook, append([]string{event.TunnelType}, event.Pools...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// poolNames returns the names of the pools with the supplied CIDRs. The CIDR is returned in place of the name of any
+// pool that cannot be found.
+func poolNames(ctx context.Context, c client.Interface, cidrs []net.IPNet) []string {
+	names := map[string]string{}
+	if ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{}); err == nil {
+		for _, ipPool := range ipPoolList.Items {
+			if _, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR); err == nil {
+				names[poolCidr.String()] = ipPool.Name
+			}
+		}
+	}
+	var result []string
+	for _, cidr := range cidrs {
+		if name, ok := names[cidr.String()]; ok {
+			result = append(result, name)
+		} else {
+			result = append(result, cidr.String())
+		}
+	}
+	return result
+}
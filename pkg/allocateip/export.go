@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// tunnelAddrExport is a snapshot of the tunnel addresses of all nodes and their IPAM allocations.
+type tunnelAddrExport struct {
+	Time        time.Time              `json:"time"`
+	Allocations []tunnelAddrAllocation `json:"allocations"`
+}
+
+// tunnelAddrAllocation is the status of a single tunnel address of a node, along with the IPAM handle used for that
+// type of tunnel address on the node and the addresses allocated with it.
+type tunnelAddrAllocation struct {
+	tunnelAddrStatus
+	Handle          string   `json:"handle"`
+	HandleAddresses []string `json:"handleAddresses"`
+}
+
+// exportTunnelAddrs returns a snapshot of the tunnel addresses of all nodes and their IPAM allocations.
+func exportTunnelAddrs(ctx context.Context, c client.Interface, conf *Config) (*tunnelAddrExport, error) {
+	nodeList, err := c.Nodes().List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, ErrDatastoreUnavailable{Operation: "list nodes", Err: err}
+	}
+	statuses, err := getTunnelAddrStatuses(ctx, c, conf, nodeList.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	export := &tunnelAddrExport{Time: getClock(ctx).Now().UTC(), Allocations: []tunnelAddrAllocation{}}
+	for _, status := range statuses {
+		handle, _ := generateHandleAndAttributes(status.Node, status.Type)
+		alloc := tunnelAddrAllocation{tunnelAddrStatus: status, Handle: handle, HandleAddresses: []string{}}
+		ips, err := c.IPAM().IPsByHandle(ctx, handle)
+		if err != nil {
+			if _, ok := err.(cerrors.ErrorResourceDoesNotExist); !ok {
+				return nil, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+			}
+		}
+		for _, ip := range ips {
+			alloc.HandleAddresses = append(alloc.HandleAddresses, ip.String())
+		}
+		export.Allocations = append(export.Allocations, alloc)
+	}
+	return export, nil
+}
+
+// writeExportJSON writes the tunnel address snapshot as JSON.
+func writeExportJSON(w io.Writer, export *tunnelAddrExport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(export)
+}
+
+// runExportCommand writes a snapshot of the tunnel addresses of all nodes and their IPAM allocations as JSON, for
+// backup and later audit. It does not modify anything.
+func runExportCommand(conf *Config, args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := fs.String("file", "", "File to write the snapshot to, defaults to stdout")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	_, c := createClient(conf)
+	export, err := exportTunnelAddrs(context.Background(), c, conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export tunnel addresses: %v\n", err)
+		return 1
+	}
+
+	w := os.Stdout
+	if *file != "" {
+		if w, err = os.Create(*file); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *file, err)
+			return 1
+		}
+		defer w.Close()
+	}
+	if err := writeExportJSON(w, export); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write output: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// fakeClock is a clock whose time only moves when it is slept on, so that the retry loops run instantly and
+// deterministically. It records the durations slept.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.advance(d)
+	return nil
+}
+
+func (f *fakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	ch <- f.advance(d)
+	return ch
+}
+
+// advance moves the time forward by the supplied duration, returning the new time.
+func (f *fakeClock) advance(d time.Duration) time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.now = f.now.Add(d)
+	f.sleeps = append(f.sleeps, d)
+	return f.now
+}
+
+// slept returns the durations slept so far.
+func (f *fakeClock) slept() []time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]time.Duration(nil), f.sleeps...)
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// Method names used to configure failures on the fakes.
+const (
+	methodAutoAssign              = "AutoAssign"
+	methodAssignIP                = "AssignIP"
+	methodReleaseIPs              = "ReleaseIPs"
+	methodReleaseByHandle         = "ReleaseByHandle"
+	methodGetAssignmentAttributes = "GetAssignmentAttributes"
+	methodNodeGet                 = "Get"
+	methodNodeUpdate              = "Update"
+)
+
+// newConflictError returns an error simulating a conflicting update in the datastore.
+func newConflictError() error {
+	return cerrors.ErrorResourceUpdateConflict{Err: errors.New("mock conflict error")}
+}
+
+// newTransientError returns an error simulating a transient datastore failure.
+func newTransientError() error {
+	return cerrors.ErrorDatastoreError{Err: errors.New("mock transient datastore error")}
+}
+
+// newPoolNotFoundError returns an error simulating a release of an address whose pool has been deleted.
+func newPoolNotFoundError() error {
+	return errors.New("The provided IP address 172.16.0.1 is not in a configured pool")
+}
+
+// faultInjector tracks the calls made to each method of a fake, and returns the errors configured for those calls.
+type faultInjector struct {
+	lock   sync.Mutex
+	calls  map[string]int
+	nth    map[string]map[int]error
+	always map[string]error
+}
+
+func newFaultInjector() faultInjector {
+	return faultInjector{
+		calls:  map[string]int{},
+		nth:    map[string]map[int]error{},
+		always: map[string]error{},
+	}
+}
+
+// failCall configures the nth (1-indexed) call to the named method to return err.
+func (f *faultInjector) failCall(method string, n int, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.nth[method] == nil {
+		f.nth[method] = map[int]error{}
+	}
+	f.nth[method][n] = err
+}
+
+// failAllCalls configures every call to the named method to return err.
+func (f *faultInjector) failAllCalls(method string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.always[method] = err
+}
+
+// numCalls returns the number of calls made to the named method.
+func (f *faultInjector) numCalls(method string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[method]
+}
+
+// recordCall records a call to the named method, returning the error to inject, or nil if the call should be passed
+// through to the wrapped client.
+func (f *faultInjector) recordCall(method string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls[method]++
+	if err, ok := f.nth[method][f.calls[method]]; ok {
+		return err
+	}
+	return f.always[method]
+}
+
+// fakeIPAM wraps an ipam.Interface, allowing tests to simulate pool exhaustion and inject errors into the IPAM calls
+// made by the tunnel address allocator. Calls that are not configured to fail are passed through to the wrapped client.
+type fakeIPAM struct {
+	ipam.Interface
+	faultInjector
+
+	// exhausted causes AutoAssign to return no addresses, as if all of the requested pools are full.
+	exhausted bool
+
+	// exhaustedCalls causes the first exhaustedCalls calls to AutoAssign to return no addresses, as if capacity is
+	// added to the pools after that.
+	exhaustedCalls int
+
+	// assignFromPools, if set, replaces the IPv4 pools requested in AutoAssign, simulating an IPAM that does not
+	// honor the requested pools.
+	assignFromPools []net.IPNet
+
+	// assignIPv6 causes AutoAssign to return an IPv6 address in place of the IPv4 address it assigned, simulating an
+	// IPAM that returns the wrong address family. The IPv4 address remains allocated with the handle.
+	assignIPv6 bool
+
+	// interruptAutoAssign, if set, is called after AutoAssign has assigned the addresses, and AutoAssign then returns
+	// context.Canceled. This simulates a shutdown signal arriving while an assignment is in progress.
+	interruptAutoAssign context.CancelFunc
+}
+
+func newFakeIPAM(ic ipam.Interface) *fakeIPAM {
+	return &fakeIPAM{Interface: ic, faultInjector: newFaultInjector()}
+}
+
+func (f *fakeIPAM) AutoAssign(ctx context.Context, args ipam.AutoAssignArgs) (*ipam.IPAMAssignments, *ipam.IPAMAssignments, error) {
+	if err := f.recordCall(methodAutoAssign); err != nil {
+		return nil, nil, err
+	}
+	if f.exhausted || f.numCalls(methodAutoAssign) <= f.exhaustedCalls {
+		return &ipam.IPAMAssignments{IPVersion: 4, NumRequested: args.Num4},
+			&ipam.IPAMAssignments{IPVersion: 6, NumRequested: args.Num6},
+			nil
+	}
+	if f.assignFromPools != nil {
+		args.IPv4Pools = f.assignFromPools
+	}
+	if f.assignIPv6 {
+		v4, v6, err := f.Interface.AutoAssign(ctx, args)
+		if err == nil && len(v4.IPs) > 0 {
+			v4.IPs[0] = net.MustParseCIDR("fd00::1/128")
+		}
+		return v4, v6, err
+	}
+	if f.interruptAutoAssign != nil {
+		if _, _, err := f.Interface.AutoAssign(ctx, args); err != nil {
+			return nil, nil, err
+		}
+		f.interruptAutoAssign()
+		return nil, nil, context.Canceled
+	}
+	return f.Interface.AutoAssign(ctx, args)
+}
+
+func (f *fakeIPAM) AssignIP(ctx context.Context, args ipam.AssignIPArgs) error {
+	if err := f.recordCall(methodAssignIP); err != nil {
+		return err
+	}
+	return f.Interface.AssignIP(ctx, args)
+}
+
+func (f *fakeIPAM) ReleaseIPs(ctx context.Context, ips []net.IP) ([]net.IP, error) {
+	if err := f.recordCall(methodReleaseIPs); err != nil {
+		return nil, err
+	}
+	return f.Interface.ReleaseIPs(ctx, ips)
+}
+
+func (f *fakeIPAM) ReleaseByHandle(ctx context.Context, handleID string) error {
+	if err := f.recordCall(methodReleaseByHandle); err != nil {
+		return err
+	}
+	return f.Interface.ReleaseByHandle(ctx, handleID)
+}
+
+func (f *fakeIPAM) GetAssignmentAttributes(ctx context.Context, addr net.IP) (map[string]string, *string, error) {
+	if err := f.recordCall(methodGetAssignmentAttributes); err != nil {
+		return nil, nil, err
+	}
+	return f.Interface.GetAssignmentAttributes(ctx, addr)
+}
+
+// fakeNodes wraps a client.NodeInterface, allowing tests to inject errors into node Get and Update calls. It records
+// the nodes passed to successful updates so that tests can check intermediate states.
+type fakeNodes struct {
+	client.NodeInterface
+	faultInjector
+
+	updatedLock sync.Mutex
+	updated     []libapi.Node
+
+	// beforeUpdate, if set, is called before each Update is passed through to the wrapped client. This allows tests
+	// to simulate a concurrent writer.
+	beforeUpdate func()
+}
+
+// updates returns a copy of the nodes passed to successful updates.
+func (f *fakeNodes) updates() []libapi.Node {
+	f.updatedLock.Lock()
+	defer f.updatedLock.Unlock()
+	return append([]libapi.Node(nil), f.updated...)
+}
+
+func (f *fakeNodes) Get(ctx context.Context, name string, opts options.GetOptions) (*libapi.Node, error) {
+	if err := f.recordCall(methodNodeGet); err != nil {
+		return nil, err
+	}
+	return f.NodeInterface.Get(ctx, name, opts)
+}
+
+func (f *fakeNodes) Update(ctx context.Context, res *libapi.Node, opts options.SetOptions) (*libapi.Node, error) {
+	if err := f.recordCall(methodNodeUpdate); err != nil {
+		return nil, err
+	}
+	if f.beforeUpdate != nil {
+		f.beforeUpdate()
+	}
+	node, err := f.NodeInterface.Update(ctx, res, opts)
+	if err == nil {
+		f.updatedLock.Lock()
+		f.updated = append(f.updated, *node.DeepCopy())
+		f.updatedLock.Unlock()
+	}
+	return node, err
+}
+
+// fakeClient wraps a client.Interface, replacing the IPAM and node clients with fakes.
+type fakeClient struct {
+	client.Interface
+	ipam  *fakeIPAM
+	nodes *fakeNodes
+}
+
+func newFakeClient(c client.Interface) *fakeClient {
+	return &fakeClient{
+		Interface: c,
+		ipam:      newFakeIPAM(c.IPAM()),
+		nodes:     &fakeNodes{NodeInterface: c.Nodes(), faultInjector: newFaultInjector()},
+	}
+}
+
+func (c *fakeClient) IPAM() ipam.Interface {
+	return c.ipam
+}
+
+func (c *fakeClient) Nodes() client.NodeInterface {
+	return c.nodes
+}
+
+// blockingIPAM is an ipam.Interface whose AutoAssign blocks until its context is done.
+type blockingIPAM struct {
+	ipam.Interface
+}
+
+func (b blockingIPAM) AutoAssign(ctx context.Context, args ipam.AutoAssignArgs) (*ipam.IPAMAssignments, *ipam.IPAMAssignments, error) {
+	<-ctx.Done()
+	return nil, nil, ctx.Err()
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// handleAddrCounts returns the number of addresses held in IPAM by each of the node's tunnel address handles, by
+// tunnel type.
+func handleAddrCounts(ctx context.Context, c client.Interface, nodename string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, attrType := range reconcileOrder {
+		handle, _ := generateHandleAndAttributes(nodename, attrType)
+		ips, err := c.IPAM().IPsByHandle(ctx, handle)
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+			ips = nil
+		} else if err != nil {
+			return nil, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+		}
+		counts[attrType] = len(ips)
+	}
+	return counts, nil
+}
+
+// expectedHandleAddrCount returns the number of addresses the node's handle for the tunnel address type should hold:
+// one if the node has an address of the type that is not user-managed, plus any removed addresses awaiting release.
+func expectedHandleAddrCount(conf *Config, node *libapi.Node, attrType string) int {
+	expected := 0
+	addr := getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0])
+	if addr != "" && !isUserManagedTunnelAddr(node, attrType) {
+		expected++
+	}
+	handle, _ := generateHandleAndAttributes(node.Name, attrType)
+	for pendingAddr, pendingHandle := range pendingReleases(node) {
+		if pendingHandle == handle && pendingAddr != addr {
+			expected++
+		}
+	}
+	return expected
+}
+
+// checkHandleAddrCounts records the number of addresses held by each of the node's tunnel address handles after a
+// reconcile, warning if a handle of a managed type holds a different number than expected. More addresses than
+// expected indicates a leak from an interrupted operation, and fewer an address that is set on the node but no longer
+// allocated in IPAM. A failure to count the addresses is logged but not returned, since the counts are informational.
+func checkHandleAddrCounts(ctx context.Context, c client.Interface, conf *Config, nodename string, states map[string]desiredState) {
+	logCtx := getLogger(ctx, "").WithField("node", nodename)
+	counts, err := handleAddrCounts(ctx, c, nodename)
+	if err != nil {
+		logCtx.WithError(err).Warn("Failed to count the addresses held by the tunnel address handles")
+		return
+	}
+	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		logCtx.WithError(nodeOperationError("get", nodename, err)).Warn("Failed to count the addresses held by the tunnel address handles")
+		return
+	}
+	for _, attrType := range reconcileOrder {
+		count := counts[attrType]
+		gaugeTunnelHandleAddrs.WithLabelValues(nodename, attrType).Set(float64(count))
+		if states[attrType].Action == tunnelActionSkip {
+			// The type is not managed by us, so any addresses held by its handle are not our concern.
+			continue
+		}
+		if expected := expectedHandleAddrCount(conf, node, attrType); count != expected {
+			getLogger(ctx, attrType).WithFields(log.Fields{
+				"node":     nodename,
+				"count":    count,
+				"expected": expected,
+			}).Warn("Tunnel address handle holds an unexpected number of addresses")
+			addRunWarning(ctx, "%s: handle holds %d addresses, expected %d", attrType, count, expected)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// logFieldKeys are the structured log field keys that may be renamed with LogFieldNames.
+var logFieldKeys = map[string]bool{
+	"type":   true,
+	"node":   true,
+	"Node":   true,
+	"IP":     true,
+	"handle": true,
+	"run_id": true,
+}
+
+// logFieldNamesHook renames the structured fields of each log entry as it is fired, so that the logs fit the schema of
+// an existing log pipeline. Renaming the fields as they are fired, rather than where they are set, covers every log
+// call without each having to look up the names.
+type logFieldNamesHook struct {
+	lock  sync.RWMutex
+	names map[string]string
+}
+
+// logFieldNames is the hook that renames the log fields, added to the standard logger the first time any renames are
+// configured. Later runs in the same process replace its renames rather than adding another hook.
+var (
+	logFieldNames            = &logFieldNamesHook{}
+	installLogFieldNamesOnce sync.Once
+)
+
+func (h *logFieldNamesHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire replaces the entry's fields with a renamed copy, since the fields may be shared with the entry it was derived
+// from, which must not be modified.
+func (h *logFieldNamesHook) Fire(entry *log.Entry) error {
+	h.lock.RLock()
+	names := h.names
+	h.lock.RUnlock()
+	if len(names) == 0 {
+		return nil
+	}
+
+	data := make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		if name, ok := names[key]; ok {
+			key = name
+		}
+		data[key] = value
+	}
+	entry.Data = data
+	return nil
+}
+
+// setNames replaces the renames made by the hook.
+func (h *logFieldNamesHook) setNames(names map[string]string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.names = names
+}
+
+// installLogFieldNames renames the log fields as configured by LogFieldNames, replacing the renames of any earlier
+// run, or returns an error if the renames are invalid.
+func (conf *Config) installLogFieldNames() error {
+	if errs := validateLogFieldNames(conf.LogFieldNames); len(errs) > 0 {
+		return fmt.Errorf("invalid log field names: %v", errs)
+	}
+	logFieldNames.setNames(conf.LogFieldNames)
+	if len(conf.LogFieldNames) > 0 {
+		installLogFieldNamesOnce.Do(func() {
+			log.AddHook(logFieldNames)
+		})
+	}
+	return nil
+}
+
+// parseLogFieldNames parses the comma separated list of log field renames from the named variable, e.g.
+// "IP=ip,run_id=trace_id", returning nil if it is unset.
+func parseLogFieldNames(src configSource, env string) map[string]string {
+	var names map[string]string
+	for _, rename := range strings.Split(src(env), ",") {
+		if rename = strings.TrimSpace(rename); rename == "" {
+			continue
+		}
+		parts := strings.SplitN(rename, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("Invalid value for %s: %q, must be a comma separated list of field=name", env, rename)
+		}
+		if names == nil {
+			names = map[string]string{}
+		}
+		names[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return names
+}
+
+// validateLogFieldNames returns the problems with the log field renames: each must rename a known field to a non-empty
+// name that is not also the name of another field, so that no two fields are logged under the same key.
+func validateLogFieldNames(names map[string]string) []error {
+	var errs []error
+	used := map[string]string{}
+	for key, name := range names {
+		if !logFieldKeys[key] {
+			errs = append(errs, fmt.Errorf("unknown log field '%s'", key))
+		} else if name == "" {
+			errs = append(errs, fmt.Errorf("log field '%s' has an empty name", key))
+		} else if other, ok := used[name]; ok {
+			errs = append(errs, fmt.Errorf("log fields '%s' and '%s' are both named '%s'", other, key, name))
+		}
+		used[name] = key
+	}
+	for key := range logFieldKeys {
+		if _, renamed := names[key]; !renamed {
+			if other, ok := used[key]; ok {
+				errs = append(errs, fmt.Errorf("log field '%s' is renamed to '%s', which is the name of another field", other, key))
+			}
+		}
+	}
+	return errs
+}
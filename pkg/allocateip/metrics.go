@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	gaugeLastSuccessfulReconcile = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "calico_tunnel_addr_last_successful_reconcile_timestamp_seconds",
+		Help: "Unix time at which tunnel address reconciliation last completed successfully for the node.",
+	}, []string{"node"})
+	gaugeDuplicateTunnelAddrs = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "calico_tunnel_addr_duplicates",
+		Help: "Number of tunnel addresses claimed by more than one node or tunnel type at the last duplicate check.",
+	})
+	histogramDatastoreOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "calico_tunnel_addr_datastore_operation_duration_seconds",
+		Help:    "Duration of the datastore operations made by the tunnel address allocator.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+	counterTunnelAddrAssignments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "calico_tunnel_addr_assignments_total",
+		Help: "Number of tunnel addresses assigned, by tunnel type and the pool the address was assigned from.",
+	}, []string{"type", "pool"})
+	gaugeReconcileInterval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "calico_tunnel_addr_reconcile_interval_seconds",
+		Help: "Current interval between periodic tunnel address reconciliations, including any backoff after failures.",
+	})
+	gaugeConsecutiveReconcileFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "calico_tunnel_addr_reconcile_consecutive_failures",
+		Help: "Number of consecutive failed tunnel address reconciliations.",
+	})
+	counterSuppressedReassignments = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "calico_tunnel_addr_reassignments_suppressed_total",
+		Help: "Number of tunnel address reassignments suppressed because a reassignment limit was reached, or deferred because the reassignment cooldown had not elapsed, by tunnel type.",
+	}, []string{"type"})
+	gaugeTunnelHandleAddrs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "calico_tunnel_addr_handle_addresses",
+		Help: "Number of addresses held in IPAM by each of the node's tunnel address handles at the last reconcile, by tunnel type. Normally 1 for each type the node has an address of and 0 otherwise.",
+	}, []string{"node", "type"})
+)
+
+func init() {
+	prometheus.MustRegister(gaugeLastSuccessfulReconcile)
+	prometheus.MustRegister(gaugeDuplicateTunnelAddrs)
+	prometheus.MustRegister(histogramDatastoreOperationDuration)
+	prometheus.MustRegister(counterTunnelAddrAssignments)
+	prometheus.MustRegister(gaugeReconcileInterval)
+	prometheus.MustRegister(gaugeConsecutiveReconcileFailures)
+	prometheus.MustRegister(counterSuppressedReassignments)
+	prometheus.MustRegister(gaugeTunnelHandleAddrs)
+}
+
+// serveMetrics serves the Prometheus metrics on the listener returned by metricsListener. It runs until the server
+// fails, which is logged but otherwise ignored since the metrics are not essential to the allocator.
+func serveMetrics(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.WithField("addr", l.Addr()).Info("Serving tunnel address allocator metrics")
+	if err := http.Serve(l, mux); err != nil {
+		log.WithError(err).Error("Metrics server failed")
+	}
+}
+
+// metricsListener listens on the configured Unix socket if there is one, or else the TCP address. It is an error for
+// both to be set. A socket file left behind by a previous run is removed first, since the listen would otherwise fail.
+func metricsListener(conf *Config) (net.Listener, error) {
+	if conf.MetricsAddr != "" && conf.MetricsSocket != "" {
+		return nil, errors.New("the metrics address and metrics socket must not both be set")
+	}
+	if conf.MetricsSocket == "" {
+		return net.Listen("tcp", conf.MetricsAddr)
+	}
+	if err := os.Remove(conf.MetricsSocket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", conf.MetricsSocket)
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrateTunnelAddr moves the node's tunnel address of the specified type from the "from" pool to the "to" pool. The
+// new address is assigned and set on the node before the old address is released, so that the node always has a
+// valid tunnel address. The new address is assigned with the usual handle, so if the migration is interrupted after
+// the assignment it is found and reused when re-run. Re-running a completed migration releases any old addresses left
+// behind, and is otherwise a no-op. Returns whether the node's address was changed.
+func migrateTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename, attrType string, from, to net.IPNet) (bool, error) {
+	logCtx := getLogger(ctx, attrType).WithFields(log.Fields{"node": nodename, "from": from.String(), "to": to.String()})
+
+	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		return false, nodeOperationError("get", nodename, err)
+	}
+	current := getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0])
+	if current == "" || (!isIpInPool(current, []net.IPNet{from}) && !isIpInPool(current, []net.IPNet{to})) {
+		logCtx.WithField("IP", current).Debug("Tunnel address is not in either pool, nothing to migrate")
+		return false, nil
+	}
+
+	// Find the addresses allocated with our handle, which include any assigned by an interrupted migration.
+	handle, attrs := generateHandleAndAttributes(nodename, attrType)
+	conf.addClusterAttribute(attrs)
+	ips, err := c.IPAM().IPsByHandle(ctx, handle)
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+		ips = nil
+	} else if err != nil {
+		return false, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+	}
+
+	changed := false
+	if isIpInPool(current, []net.IPNet{from}) {
+		// Make sure the new pool is enabled for this node and tunnel type, otherwise the next reconcile would just
+		// move the address again.
+		ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+		if err != nil {
+			return false, ErrDatastoreUnavailable{Operation: "list IP pools", Err: err}
+		}
+		if !isIpInPool(to.IP.String(), tunnelPoolIndex(ctx, conf, *node, *ipPoolList)[attrType]) {
+			return false, fmt.Errorf("pool %s is not enabled for %s addresses on node '%s'", to.String(), attrType, nodename)
+		}
+
+		// Reuse an address in the new pool from an interrupted migration, or assign one.
+		newAddr := ""
+		for _, ip := range ips {
+			if isIpInPool(ip.String(), []net.IPNet{to}) {
+				newAddr = ip.String()
+				break
+			}
+		}
+		if newAddr == "" {
+			v4Assignments, _, err := c.IPAM().AutoAssign(ctx, ipam.AutoAssignArgs{
+				Num4:        1,
+				HandleID:    &handle,
+				Attrs:       attrs,
+				Hostname:    conf.ipamHostname(nodename),
+				IPv4Pools:   []net.IPNet{to},
+				IntendedUse: api.IPPoolAllowedUseTunnel,
+			})
+			if err != nil {
+				return false, ErrDatastoreUnavailable{Operation: "autoassign tunnel address", Err: err}
+			} else if err := checkAssignments(v4Assignments, 1); err != nil {
+				return false, err
+			}
+			newAddr = v4Assignments.IPs[0].IP.String()
+		}
+
+		// Switch the node to the new address. If this fails, the new address is left allocated with our handle so
+		// that it is reused when the migration is re-run.
+		if err := updateNodeWithAddress(ctx, c, conf, nodename, newAddr, []net.IPNet{to}, attrType, AuditReasonMigrated); err != nil {
+			return false, err
+		}
+		logCtx.WithFields(log.Fields{"oldIP": current, "IP": newAddr}).Info("Migrated tunnel address to new pool")
+		changed = true
+	}
+
+	// Release the old addresses in the "from" pool. This includes the old address if it was allocated without a handle.
+	var release []net.IP
+	for _, ip := range ips {
+		if isIpInPool(ip.String(), []net.IPNet{from}) {
+			release = append(release, ip)
+		}
+	}
+	if changed && len(release) == 0 {
+		if allocated, err := isTunnelAddrAllocated(ctx, c, nodename, current, attrType); err != nil {
+			return changed, err
+		} else if allocated {
+			release = append(release, *net.ParseIP(current))
+		}
+	}
+	if len(release) > 0 {
+		if err := releaseIPs(ctx, c, release, logCtx); err != nil {
+			return changed, err
+		}
+		logCtx.WithField("IPs", release).Info("Released old tunnel addresses")
+	}
+	return changed, nil
+}
+
+// runMigrateCommand migrates the tunnel addresses of the node, or all nodes, from one pool to another.
+func runMigrateCommand(conf *Config, nodename string, args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Migrate the tunnel addresses of all nodes")
+	fromFlag := fs.String("from", "", "CIDR of the pool to migrate tunnel addresses from")
+	toFlag := fs.String("to", "", "CIDR of the pool to migrate tunnel addresses to")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	_, from, err := net.ParseCIDR(*fromFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --from pool CIDR %q\n", *fromFlag)
+		return 1
+	}
+	_, to, err := net.ParseCIDR(*toFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --to pool CIDR %q\n", *toFlag)
+		return 1
+	}
+	if !*all && nodename == "" {
+		fmt.Fprintln(os.Stderr, "NODENAME environment is not set, use --node or --all")
+		return 1
+	}
+
+	_, c := createClient(conf)
+	ctx, stop := signalContext()
+	defer stop()
+
+	nodenames := []string{nodename}
+	if *all {
+		nodeList, err := c.Nodes().List(ctx, options.ListOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list nodes: %v\n", err)
+			return 1
+		}
+		nodenames = nodeNames(nodeList.Items)
+	}
+
+	failed := false
+	for _, name := range nodenames {
+		for _, attrType := range tunnelAttrTypes {
+			if conf.UnmanagedTunnelAddrTypes[attrType] {
+				continue
+			}
+			changed, err := migrateTunnelAddr(withRunID(ctx, newRunID()), c, conf, name, attrType, *from, *to)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to migrate %s address of node '%s': %v\n", attrType, name, err)
+				failed = true
+			} else if changed {
+				fmt.Printf("Migrated %s address of node '%s'\n", attrType, name)
+			}
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// nodeNames returns the names of the nodes.
+func nodeNames(nodes []libapi.Node) []string {
+	names := make([]string, len(nodes))
+	for i := range nodes {
+		names[i] = nodes[i].Name
+	}
+	return names
+}
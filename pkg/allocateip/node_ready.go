@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/backend/k8s"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+)
+
+// isNodeReadyForAssignment returns whether a tunnel address may be assigned to the node. The Kubernetes node must
+// be Ready when using the Kubernetes datastore, there is no equivalent check for other datastores.
+func isNodeReadyForAssignment(ctx context.Context, c client.Interface, nodename string) (bool, error) {
+	bc, ok := c.(backendClientAccessor)
+	if !ok {
+		return true, nil
+	}
+	kc, ok := bc.Backend().(*k8s.KubeClient)
+	if !ok {
+		// Not using the Kubernetes datastore.
+		return true, nil
+	}
+	return isK8sNodeReady(ctx, kc.ClientSet, nodename)
+}
+
+// isK8sNodeReady returns whether the Kubernetes node has a Ready condition with status True.
+func isK8sNodeReady(ctx context.Context, cs kubernetes.Interface, nodename string) (bool, error) {
+	node, err := cs.CoreV1().Nodes().Get(ctx, nodename, metav1.GetOptions{})
+	if err != nil {
+		return false, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get Kubernetes node '%s'", nodename), Err: err}
+	}
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
+
+// isWindowsNode returns whether the node is labelled as running Windows, which supports VXLAN but not IPIP.
+func isWindowsNode(node *libapi.Node) bool {
+	return node.Labels[v1.LabelOSStable] == "windows"
+}
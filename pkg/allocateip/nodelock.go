@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The node lock prevents concurrent invocations of the allocator for the same node, e.g. an init container and a
+// manual run, from both assigning an address and fighting over the node update, which can leak an address. It is an
+// advisory flock(2) on a lock file per node in NodeLockDir, held for the duration of each reconcile, so a second
+// invocation waits for the first to finish its reconcile, up to NodeLockTimeout, before giving up.
+//
+// The lock is local to the host and is held by the kernel on behalf of the process, which has these failure modes:
+//
+//   - It only serializes invocations that share the lock directory, e.g. the containers on a node that mount the same
+//     host path. An invocation on another host, such as an operator managing a remote node, is not serialized.
+//   - If the lock directory or file cannot be created, e.g. because the directory is read-only, the reconcile goes
+//     ahead without the lock, with a warning.
+//   - The lock is released by the kernel when the holding process exits, even if it crashes, so a stale lock file is
+//     harmless. However a holder that hangs holds the lock until it is killed, and the other invocations time out.
+//   - Locking is not supported on Windows, where the reconcile always goes ahead without the lock.
+
+const (
+	// defaultNodeLockDir is the directory of the node lock files, if not configured.
+	defaultNodeLockDir = "/var/run/calico"
+
+	// defaultNodeLockTimeout is the time to wait for another invocation to release the node lock, if not configured.
+	defaultNodeLockTimeout = 30 * time.Second
+
+	// nodeLockPollInterval is the interval at which the node lock is retried while another invocation holds it.
+	nodeLockPollInterval = time.Second
+)
+
+// nodeLockPath returns the path of the lock file of the node.
+func (conf *Config) nodeLockPath(nodename string) string {
+	dir := conf.NodeLockDir
+	if dir == "" {
+		dir = defaultNodeLockDir
+	}
+	return filepath.Join(dir, fmt.Sprintf("allocate-tunnel-addrs-%s.lock", nodename))
+}
+
+// nodeLockTimeout returns the time to wait for another invocation to release the node lock.
+func (conf *Config) nodeLockTimeout() time.Duration {
+	if conf.NodeLockTimeout == 0 {
+		return defaultNodeLockTimeout
+	}
+	return conf.NodeLockTimeout
+}
+
+// lockNode acquires the node lock, waiting for another invocation to release it if necessary, and returns a function
+// that releases it. If the lock cannot be used at all, the returned function does nothing.
+func lockNode(ctx context.Context, conf *Config, nodename string) (func(), error) {
+	path := conf.nodeLockPath(nodename)
+	logCtx := log.WithFields(log.Fields{"node": nodename, "file": path})
+	unlocked := func() {}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logCtx.WithError(err).Warn("Unable to create the node lock directory, continuing without the lock")
+		return unlocked, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		logCtx.WithError(err).Warn("Unable to open the node lock file, continuing without the lock")
+		return unlocked, nil
+	}
+
+	timeout := conf.nodeLockTimeout()
+	deadline := getClock(ctx).Now().Add(timeout)
+	for waiting := false; ; waiting = true {
+		locked, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			logCtx.WithError(err).Warn("Unable to lock the node lock file, continuing without the lock")
+			return unlocked, nil
+		} else if locked {
+			logCtx.Debug("Acquired the node lock")
+			return func() {
+				if err := unlockFile(f); err != nil {
+					logCtx.WithError(err).Warn("Failed to release the node lock")
+				}
+				_ = f.Close()
+			}, nil
+		}
+
+		if !getClock(ctx).Now().Before(deadline) {
+			_ = f.Close()
+			return nil, ErrNodeLocked{Node: nodename, Path: path, Timeout: timeout}
+		} else if !waiting {
+			logCtx.Info("Another invocation is reconciling the node's tunnel addresses, waiting for it to finish")
+		}
+		if err := sleepCtx(ctx, nodeLockPollInterval); err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+	}
+}
+
+// reconcileLocked reconciles the node's tunnel addresses while holding the node lock.
+func reconcileLocked(ctx context.Context, a *Allocator, nodename string) (map[string]TunnelAddrResult, error) {
+	unlock, err := lockNode(ctx, a.conf, nodename)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return a.Reconcile(ctx, nodename)
+}
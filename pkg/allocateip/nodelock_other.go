@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package allocateip
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// tryLockFile is only supported on Linux, so elsewhere the reconcile goes ahead without the node lock. This allows
+// the package to be built and tested on developer machines.
+func tryLockFile(f *os.File) (bool, error) {
+	return false, fmt.Errorf("file locking is not supported on %s", runtime.GOOS)
+}
+
+// unlockFile is only supported on Linux.
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// defaultPoolCacheResync is the maximum age of the cached pool list, if not configured.
+const defaultPoolCacheResync = 5 * time.Minute
+
+// poolCache holds the most recently listed IP pools, so that the reconciles in daemon mode do not each list the pools
+// from the datastore. The reconciler invalidates the cache when the syncer reports a change, and the pools are listed
+// again once the cache is older than the resync period, in case a change was missed. Nodes are not cached, since the
+// node is updated with the resource version it was read at and a stale read would only cause update conflicts.
+type poolCache struct {
+	lock    sync.Mutex
+	list    *api.IPPoolList
+	fetched time.Time
+	resync  time.Duration
+}
+
+func newPoolCache(resync time.Duration) *poolCache {
+	if resync == 0 {
+		resync = defaultPoolCacheResync
+	}
+	return &poolCache{resync: resync}
+}
+
+// invalidate discards the cached pools, so that the next list reads them from the datastore.
+func (p *poolCache) invalidate() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.list = nil
+}
+
+// get returns a copy of the cached pools, or nil if there are none or they are due a resync.
+func (p *poolCache) get(now time.Time) *api.IPPoolList {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.list == nil || now.Sub(p.fetched) >= p.resync {
+		return nil
+	}
+	return p.list.DeepCopy()
+}
+
+// set caches a copy of the listed pools.
+func (p *poolCache) set(list *api.IPPoolList, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.list = list.DeepCopy()
+	p.fetched = now
+}
+
+// poolCacheClient wraps a client.Interface, serving unfiltered IP pool lists from a poolCache.
+type poolCacheClient struct {
+	client.Interface
+	pools *poolCache
+}
+
+func newPoolCacheClient(c client.Interface, pools *poolCache) *poolCacheClient {
+	return &poolCacheClient{Interface: c, pools: pools}
+}
+
+func (c *poolCacheClient) IPPools() client.IPPoolInterface {
+	return &cachedIPPools{IPPoolInterface: c.Interface.IPPools(), cache: c.pools}
+}
+
+// Backend returns the backend client of the wrapped client, or nil if it does not expose one.
+func (c *poolCacheClient) Backend() bapi.Client {
+	if bc, ok := c.Interface.(backendClientAccessor); ok {
+		return bc.Backend()
+	}
+	return nil
+}
+
+// cachedIPPools wraps a client.IPPoolInterface, serving unfiltered lists from the cache. Lists with options, and all
+// other operations, are passed through to the datastore.
+type cachedIPPools struct {
+	client.IPPoolInterface
+	cache *poolCache
+}
+
+func (p *cachedIPPools) List(ctx context.Context, opts options.ListOptions) (*api.IPPoolList, error) {
+	if opts != (options.ListOptions{}) {
+		return p.IPPoolInterface.List(ctx, opts)
+	}
+	now := getClock(ctx).Now()
+	if list := p.cache.get(now); list != nil {
+		return list, nil
+	}
+	list, err := p.IPPoolInterface.List(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	p.cache.set(list, now)
+	return list, nil
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// parseIPv4PoolsOverride parses a comma-separated list of IPv4 pool CIDRs, e.g. "10.0.0.0/16,10.1.0.0/16". Each must be
+// in canonical form, with no host bits set, since IPAM only assigns from a CIDR that matches an IP pool exactly.
+func parseIPv4PoolsOverride(value string) ([]net.IPNet, error) {
+	var cidrs []net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		ip, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pool CIDR '%s': %w", s, err)
+		} else if cidr.Version() != 4 {
+			return nil, fmt.Errorf("pool CIDR '%s' is not an IPv4 CIDR", s)
+		} else if !ip.Equal(cidr.IP) {
+			return nil, fmt.Errorf("pool CIDR '%s' has host bits set, did you mean '%s'?", s, cidr.String())
+		}
+		cidrs = append(cidrs, *cidr)
+	}
+	if len(cidrs) == 0 {
+		return nil, fmt.Errorf("no pool CIDRs in '%s'", value)
+	}
+	return cidrs, nil
+}
+
+// override returns a copy of the index in which each tunnel address type with eligible pools is assigned from the
+// supplied CIDRs instead. Types with no eligible pools are left without, so the override changes which pools the
+// addresses come from but not which types of address the node has.
+func (idx poolIndex) override(cidrs []net.IPNet) poolIndex {
+	overridden := poolIndex{}
+	for attrType, pools := range idx {
+		if len(pools) > 0 {
+			overridden[attrType] = cidrs
+		}
+	}
+	return overridden
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"math/big"
+	"sort"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// PoolSelectionStrategy determines which of the enabled pools a tunnel address is assigned from.
+type PoolSelectionStrategy string
+
+const (
+	// PoolSelectionFirstAvailable assigns from the first enabled pool with space. This is the default.
+	PoolSelectionFirstAvailable PoolSelectionStrategy = "first-available"
+
+	// PoolSelectionLeastUtilized assigns from the enabled pool with the lowest proportion of allocated addresses that
+	// has space, falling back to the more utilized pools in turn.
+	PoolSelectionLeastUtilized PoolSelectionStrategy = "least-utilized"
+)
+
+// poolSelector returns the pools to pass to AutoAssign, chosen from the enabled pools.
+type poolSelector func(ctx context.Context, c client.Interface, cidrs []net.IPNet) ([]net.IPNet, error)
+
+// poolSelectors maps each strategy to its implementation.
+var poolSelectors = map[PoolSelectionStrategy]poolSelector{
+	PoolSelectionFirstAvailable: selectAllPools,
+	PoolSelectionLeastUtilized:  selectLeastUtilizedPool,
+}
+
+// selectPools returns the pools that a tunnel address should be assigned from using the configured strategy. An
+// unset or unknown strategy falls back to the default. If a tunnel block size is configured, only the pools with that
+// block size are considered.
+func selectPools(ctx context.Context, c client.Interface, conf *Config, cidrs []net.IPNet) ([]net.IPNet, error) {
+	if conf.TunnelBlockSize != 0 {
+		var err error
+		if cidrs, err = filterPoolsByBlockSize(ctx, c, cidrs, conf.TunnelBlockSize); err != nil {
+			return nil, err
+		}
+	}
+
+	selector, ok := poolSelectors[conf.PoolSelection]
+	if !ok {
+		if conf.PoolSelection != "" {
+			getLogger(ctx, "").WithField("strategy", conf.PoolSelection).Warn("Unknown pool selection strategy, using default")
+		}
+		selector = poolSelectors[PoolSelectionFirstAvailable]
+	}
+	return selector(ctx, c, cidrs)
+}
+
+// filterPoolsByBlockSize returns the enabled pools that have the specified block size, or ErrIncompatibleBlockSize if
+// there are none.
+func filterPoolsByBlockSize(ctx context.Context, c client.Interface, cidrs []net.IPNet, blockSize int) ([]net.IPNet, error) {
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, ErrDatastoreUnavailable{Operation: "list IP pools", Err: err}
+	}
+	blockSizes := map[string]int{}
+	for _, ipPool := range ipPoolList.Items {
+		if _, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR); err == nil {
+			blockSizes[poolCidr.String()] = ipPool.Spec.BlockSize
+		}
+	}
+
+	var filtered []net.IPNet
+	for _, cidr := range cidrs {
+		if blockSizes[cidr.String()] == blockSize {
+			filtered = append(filtered, cidr)
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, ErrIncompatibleBlockSize{BlockSize: blockSize, Pools: cidrs}
+	}
+	getLogger(ctx, "").WithField("pools", filtered).Debugf("Restricted tunnel address assignment to pools with block size /%d", blockSize)
+	return filtered, nil
+}
+
+// selectAllPools returns all of the enabled pools, leaving IPAM to assign from the first with space.
+func selectAllPools(ctx context.Context, c client.Interface, cidrs []net.IPNet) ([]net.IPNet, error) {
+	return cidrs, nil
+}
+
+// selectLeastUtilizedPool returns the enabled pools in order of the proportion of their addresses that are allocated,
+// least utilized first, so that AutoAssign assigns from the least utilized pool with a free block and falls back to
+// the next if it has none.
+func selectLeastUtilizedPool(ctx context.Context, c client.Interface, cidrs []net.IPNet) ([]net.IPNet, error) {
+	if len(cidrs) <= 1 {
+		return cidrs, nil
+	}
+
+	usage, err := c.IPAM().GetUtilization(ctx, ipam.GetUtilizationArgs{})
+	if err != nil {
+		return nil, ErrDatastoreUnavailable{Operation: "get IPAM utilization", Err: err}
+	}
+
+	// Count the allocated addresses in each pool. Pools with no allocated blocks have no entry.
+	allocated := map[string]int64{}
+	for _, pool := range usage {
+		for _, block := range pool.Blocks {
+			allocated[pool.CIDR.String()] += int64(block.Capacity - block.Available)
+		}
+	}
+
+	// Order the pools by utilization, comparing allocated/size as allocated*otherSize to avoid floating point. The
+	// sort is stable so that pools with equal utilization keep their order.
+	allocatedTimesSize := func(used, other net.IPNet) *big.Int {
+		ones, bits := other.Mask.Size()
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		return size.Mul(size, big.NewInt(allocated[used.String()]))
+	}
+	ordered := append([]net.IPNet(nil), cidrs...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return allocatedTimesSize(ordered[i], ordered[j]).Cmp(allocatedTimesSize(ordered[j], ordered[i])) < 0
+	})
+	getLogger(ctx, "").WithField("pools", ordered).Debug("Ordered pools by utilization")
+	return ordered, nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// mixedEncapPools returns the names of the enabled pools that have both IPIP and VXLAN encapsulation enabled. Both
+// tunnel types may then be assigned addresses from the same pool, which is almost always a misconfiguration. The API
+// rejects such pools, but they may still be written directly to the datastore, e.g. as Kubernetes resources.
+func mixedEncapPools(ipPoolList api.IPPoolList) []string {
+	var names []string
+	for _, ipPool := range ipPoolList.Items {
+		if ipPool.Spec.Disabled {
+			continue
+		}
+		ipipEnabled := ipPool.Spec.IPIPMode != "" && ipPool.Spec.IPIPMode != api.IPIPModeNever
+		vxlanEnabled := ipPool.Spec.VXLANMode != "" && ipPool.Spec.VXLANMode != api.VXLANModeNever
+		if ipipEnabled && vxlanEnabled {
+			names = append(names, ipPool.Name)
+		}
+	}
+	return names
+}
+
+// validatePools checks the IP pools for encapsulation misconfigurations. Pools enabled for both IPIP and VXLAN are
+// logged as a warning, or returned as ErrMixedEncapPools if strict pool validation is configured.
+func validatePools(ctx context.Context, c client.Interface, conf *Config) error {
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return ErrDatastoreUnavailable{Operation: "list IP pools", Err: err}
+	}
+
+	names := mixedEncapPools(*ipPoolList)
+	if len(names) == 0 {
+		return nil
+	}
+	if conf.StrictPoolValidation {
+		return ErrMixedEncapPools{Pools: names}
+	}
+	log.WithField("pools", names).Warn(fmt.Sprintf(
+		"IP pools %v are enabled for both IPIP and VXLAN encapsulation, both tunnel types may be assigned addresses "+
+			"from them. This is almost always a configuration error, enable only one encapsulation per pool", names))
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// runPreflightCommand validates the allocator configuration from the environment against the datastore, without
+// assigning or releasing anything, and prints any problems found. It exits non-zero if there are any, so that it can
+// gate the rollout of a new configuration.
+func runPreflightCommand(conf *Config, nodename string, args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments %v\n", args)
+		return 1
+	}
+
+	// Invalid environment values are fatal when loading the configuration, so are reported before we get this far.
+	_, c := createClient(conf)
+
+	problems := preflight(context.Background(), c, conf, nodename)
+	if len(problems) == 0 {
+		fmt.Println("No problems found")
+		return 0
+	}
+	fmt.Printf("Found %d problem(s):\n", len(problems))
+	for _, p := range problems {
+		fmt.Printf("  - %v\n", p)
+	}
+	return 1
+}
+
+// preflight returns the problems with the configuration of the tunnel addresses of the node. It only reads from the
+// datastore.
+func preflight(ctx context.Context, c client.Interface, conf *Config, nodename string) []error {
+	problems := conf.validate()
+
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return append(problems, ErrDatastoreUnavailable{Operation: "list IP pools", Err: err})
+	}
+	if names := mixedEncapPools(*ipPoolList); len(names) > 0 && conf.StrictPoolValidation {
+		problems = append(problems, ErrMixedEncapPools{Pools: names})
+	}
+
+	if nodename == "" {
+		return append(problems, errors.New("NODENAME environment is not set, use --node"))
+	}
+	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+	if err != nil {
+		return append(problems, nodeOperationError("get", nodename, err))
+	}
+
+	// Check that the pools configured for tunnel addresses exist and may be used for them.
+	names, source, err := tunnelAddrPoolNames(ctx, c, node)
+	if err != nil {
+		return append(problems, err)
+	}
+	poolsByName := map[string]api.IPPool{}
+	for _, ipPool := range ipPoolList.Items {
+		poolsByName[ipPool.Name] = ipPool
+	}
+	for _, name := range names {
+		ipPool, ok := poolsByName[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Errorf("tunnel address pool %q configured on the %s does not exist", name, source))
+		case ipPool.Spec.Disabled:
+			problems = append(problems, fmt.Errorf("tunnel address pool %q configured on the %s is disabled", name, source))
+		case !encapEnabled(ipPool) && node.Status.WireguardPublicKey == "":
+			problems = append(problems, fmt.Errorf("tunnel address pool %q configured on the %s is not enabled for IPIP or VXLAN", name, source))
+		}
+	}
+
+	// Check that each type of tunnel address can be assigned from the pools as configured.
+	if ipPoolList, err = constrainTunnelAddrPools(ctx, c, node, ipPoolList); err != nil {
+		return append(problems, err)
+	}
+	for _, attrType := range tunnelAttrTypes {
+		for _, name := range conf.TunnelAddrPools[attrType] {
+			if problem := explicitPoolProblem(*node, *ipPoolList, name); problem != "" {
+				problems = append(problems, fmt.Errorf("%s: configured tunnel address pool %q %s", attrType, name, problem))
+			}
+		}
+	}
+	pools := tunnelPoolIndex(ctx, conf, *node, *ipPoolList)
+	for _, attrType := range tunnelAttrTypes {
+		if conf.UnmanagedTunnelAddrTypes[attrType] || len(pools[attrType]) == 0 || conf.TunnelBlockSize == 0 {
+			continue
+		}
+		if !hasPoolWithBlockSize(*ipPoolList, pools[attrType], conf.TunnelBlockSize) {
+			problems = append(problems, fmt.Errorf("%s: %w", attrType, ErrIncompatibleBlockSize{BlockSize: conf.TunnelBlockSize, Pools: pools[attrType]}))
+		}
+	}
+	return problems
+}
+
+// encapEnabled returns whether the pool has IPIP or VXLAN encapsulation enabled.
+func encapEnabled(ipPool api.IPPool) bool {
+	return (ipPool.Spec.IPIPMode != "" && ipPool.Spec.IPIPMode != api.IPIPModeNever) ||
+		(ipPool.Spec.VXLANMode != "" && ipPool.Spec.VXLANMode != api.VXLANModeNever)
+}
+
+// hasPoolWithBlockSize returns whether any of the pools with the supplied CIDRs has the block size.
+func hasPoolWithBlockSize(ipPoolList api.IPPoolList, cidrs []net.IPNet, blockSize int) bool {
+	for _, ipPool := range ipPoolList.Items {
+		if ipPool.Spec.BlockSize != blockSize {
+			continue
+		}
+		if _, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR); err == nil && isIpInPool(poolCidr.IP.String(), cidrs) {
+			return true
+		}
+	}
+	return false
+}
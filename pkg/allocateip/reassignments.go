@@ -0,0 +1,147 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// reassignmentLimiter caps the number of tunnel addresses reassigned because they are no longer within an enabled
+// pool, so that oscillating pool configuration does not repeatedly churn the node's tunnel addresses and routes. The
+// window limit is tracked across reconciles, so the limiter is owned by the Allocator.
+type reassignmentLimiter struct {
+	lock sync.Mutex
+
+	// maxPerReconcile is the maximum number of reassignments in a single reconcile, or 0 for no limit.
+	maxPerReconcile int
+
+	// maxPerWindow is the maximum number of reassignments within window, or 0 for no limit.
+	maxPerWindow int
+	window       time.Duration
+	history      []time.Time
+
+	// cooldown is the minimum time between reassignments of the same tunnel type on the same node, or 0 for none.
+	// last holds the time of the last reassignment, keyed by reassignmentKey.
+	cooldown time.Duration
+	last     map[string]time.Time
+}
+
+// newReassignmentLimiter returns a reassignmentLimiter for the configured limits. Its state is held in memory, so lasts
+// only as long as the Allocator that owns it.
+func newReassignmentLimiter(conf *Config) *reassignmentLimiter {
+	return &reassignmentLimiter{
+		maxPerReconcile: conf.MaxReassignmentsPerReconcile,
+		maxPerWindow:    conf.MaxReassignmentsPerWindow,
+		window:          conf.ReassignmentWindow,
+		cooldown:        conf.ReassignmentCooldown,
+		last:            map[string]time.Time{},
+	}
+}
+
+// reassignmentKey returns the key of the tunnel address of the specified type on the node.
+func reassignmentKey(nodename, attrType string) string {
+	return nodename + "/" + attrType
+}
+
+// reconcileReassignments counts the reassignments made in a single reconcile.
+type reconcileReassignments struct {
+	lock    sync.Mutex
+	count   int
+	limiter *reassignmentLimiter
+}
+
+// reassignmentsKey is the context key for the reassignments of the current reconcile.
+type reassignmentsKey struct{}
+
+// withReassignmentLimit returns a copy of the context that counts the reassignments of a new reconcile against the
+// limiter.
+func withReassignmentLimit(ctx context.Context, l *reassignmentLimiter) context.Context {
+	return context.WithValue(ctx, reassignmentsKey{}, &reconcileReassignments{limiter: l})
+}
+
+// allowReassignment returns whether another tunnel address may be reassigned within the limits. Reassignment is always
+// allowed if the context is not limiting them. The reassignment is only counted against the limits once it has
+// succeeded, by recordReassignment, so that a failed attempt does not use up a slot.
+func allowReassignment(ctx context.Context, now time.Time) bool {
+	r, ok := ctx.Value(reassignmentsKey{}).(*reconcileReassignments)
+	if !ok {
+		return true
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.limiter.maxPerReconcile != 0 && r.count >= r.limiter.maxPerReconcile {
+		return false
+	}
+	return r.limiter.allow(now)
+}
+
+// reassignmentCooldown returns the time remaining before the tunnel address of the specified type on the node may be
+// reassigned again, or 0 if it may be reassigned now or the context is not limiting reassignments.
+func reassignmentCooldown(ctx context.Context, nodename, attrType string, now time.Time) time.Duration {
+	r, ok := ctx.Value(reassignmentsKey{}).(*reconcileReassignments)
+	if !ok {
+		return 0
+	}
+	l := r.limiter
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	last, ok := l.last[reassignmentKey(nodename, attrType)]
+	if !ok || l.cooldown == 0 {
+		return 0
+	}
+	if remaining := last.Add(l.cooldown).Sub(now); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// recordReassignment records that the tunnel address of the specified type on the node was successfully reassigned,
+// counting it against the limits and starting its cooldown.
+func recordReassignment(ctx context.Context, nodename, attrType string, now time.Time) {
+	r, ok := ctx.Value(reassignmentsKey{}).(*reconcileReassignments)
+	if !ok {
+		return
+	}
+	r.lock.Lock()
+	r.count++
+	r.lock.Unlock()
+
+	r.limiter.lock.Lock()
+	defer r.limiter.lock.Unlock()
+	r.limiter.last[reassignmentKey(nodename, attrType)] = now
+	if r.limiter.maxPerWindow != 0 && r.limiter.window != 0 {
+		r.limiter.history = append(r.limiter.history, now)
+	}
+}
+
+// allow returns whether another reassignment is within the window limit.
+func (l *reassignmentLimiter) allow(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxPerWindow == 0 || l.window == 0 {
+		return true
+	}
+
+	// Forget the reassignments that have dropped out of the window.
+	cutoff := now.Add(-l.window)
+	i := 0
+	for i < len(l.history) && !l.history[i].After(cutoff) {
+		i++
+	}
+	l.history = l.history[i:]
+	return len(l.history) < l.maxPerWindow
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	gnet "net"
+	"strings"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// allAddressesReserved returns whether every address in the enabled pools is covered by an IP reservation. AutoAssign
+// never assigns reserved addresses, so in that case assignment can only succeed once a reservation is removed or
+// another pool is enabled. If the reservations cannot be listed, false is returned.
+func allAddressesReserved(ctx context.Context, c client.Interface, cidrs []net.IPNet, logCtx *log.Entry) bool {
+	reservations, err := c.IPReservations().List(ctx, options.ListOptions{})
+	if err != nil {
+		logCtx.WithError(err).Warn("Failed to list IP reservations, unable to check for reserved addresses")
+		return false
+	}
+
+	var reserved []net.IPNet
+	for _, r := range reservations.Items {
+		for _, s := range r.Spec.ReservedCIDRs {
+			if cidr, ok := parseReservedCIDR(s); ok {
+				reserved = append(reserved, cidr)
+			}
+		}
+	}
+	if len(reserved) == 0 {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		if !isFullyReserved(cidr, reserved) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseReservedCIDR parses an entry in an IP reservation, which may be a CIDR or a single IP address.
+func parseReservedCIDR(s string) (net.IPNet, bool) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return net.IPNet{}, false
+		}
+		bits := 32
+		if ip.To4() == nil {
+			bits = 128
+		}
+		return net.IPNet{IPNet: gnet.IPNet{IP: ip.IP, Mask: gnet.CIDRMask(bits, bits)}}, true
+	}
+	_, cidr, err := net.ParseCIDR(s)
+	if err != nil {
+		return net.IPNet{}, false
+	}
+	return *cidr, true
+}
+
+// isFullyReserved returns whether every address in the IPv4 pool is covered by the reserved CIDRs.
+func isFullyReserved(pool net.IPNet, reserved []net.IPNet) bool {
+	ones, bits := pool.Mask.Size()
+	size := uint64(1) << uint(bits-ones)
+
+	// Sum the sizes of the reserved CIDRs within the pool, ignoring any that are covered by another so that they are
+	// not counted twice. CIDRs either nest or are disjoint, so this gives the number of reserved addresses.
+	var count uint64
+	for i, r := range reserved {
+		if r.Covers(pool.IPNet) {
+			return true
+		} else if !pool.Covers(r.IPNet) {
+			continue
+		}
+		nested := false
+		for j, other := range reserved {
+			if i != j && other.Covers(r.IPNet) && (!r.Covers(other.IPNet) || j < i) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			rOnes, rBits := r.Mask.Size()
+			count += uint64(1) << uint(rBits-rOnes)
+		}
+	}
+	return count >= size
+}
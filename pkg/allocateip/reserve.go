@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// runReserveCommand reserves a tunnel address for a node that may not exist yet, by assigning it under the node's
+// standard handle. Once the node is created, the reconcile adopts the reserved address rather than assigning another,
+// as long as it is still within the node's enabled pools. This allows the address to be known before the node is
+// provisioned.
+func runReserveCommand(conf *Config, nodename string, args []string) int {
+	fs := flag.NewFlagSet("reserve", flag.ContinueOnError)
+	node := fs.String("node", nodename, "Name of the node to reserve the tunnel address for, which need not exist yet")
+	typeFlag := fs.String("type", "vxlan", "Type of tunnel address to reserve: ipip or vxlan")
+	pool := fs.String("pool", "", "Name of the IP pool to reserve the address from, defaults to the pools enabled for the type")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	attrType, ok := tunnelTypeNames[strings.ToLower(*typeFlag)]
+	if !ok || attrType == ipam.AttributeTypeWireguard {
+		// A wireguard address is only assigned once the node has a public key, so there is nothing to reserve.
+		fmt.Fprintf(os.Stderr, "Invalid --type %q, must be one of ipip or vxlan\n", *typeFlag)
+		return 1
+	}
+	if *node == "" {
+		fmt.Fprintln(os.Stderr, "NODENAME environment is not set, use --node")
+		return 1
+	}
+
+	_, c := createClient(conf)
+	ctx, stop := signalContext()
+	defer stop()
+
+	addr, reserved, err := reserveTunnelAddr(withRunID(ctx, newRunID()), c, conf, *node, attrType, *pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to reserve a %s address for node '%s': %v\n", *typeFlag, *node, err)
+		return 1
+	}
+	if !reserved {
+		fmt.Printf("The %s address %s is already allocated to node '%s'\n", *typeFlag, addr, *node)
+		return 0
+	}
+	fmt.Printf("Reserved %s address %s for node '%s'\n", *typeFlag, addr, *node)
+	return 0
+}
+
+// reserveTunnelAddr assigns a tunnel address of the specified type under the node's handle, without requiring the
+// node to exist, and returns it. If the handle already holds an address, that address is returned instead, and the
+// returned bool is false.
+func reserveTunnelAddr(ctx context.Context, c client.Interface, conf *Config, nodename, attrType, poolName string) (string, bool, error) {
+	logCtx := getLogger(ctx, attrType).WithField("node", nodename)
+	handle, attrs := generateHandleAndAttributes(nodename, attrType)
+	conf.addClusterAttribute(attrs)
+
+	ips, err := c.IPAM().IPsByHandle(ctx, handle)
+	if _, ok := err.(cerrors.ErrorResourceDoesNotExist); err != nil && !ok {
+		return "", false, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get addresses for handle '%s'", handle), Err: err}
+	} else if len(ips) > 0 {
+		return ips[0].String(), false, nil
+	}
+
+	cidrs, err := reservationPools(ctx, c, nodename, attrType, poolName)
+	if err != nil {
+		return "", false, err
+	} else if len(cidrs) == 0 {
+		return "", false, fmt.Errorf("no IP pools are enabled for %s tunnel addresses", attrType)
+	}
+
+	// IPAM may need the node to check the pools' node selectors when auto-assigning. If the assignment fails, e.g.
+	// because the node does not exist yet, assign the node's deterministic address directly instead.
+	v4Assignments, _, err := c.IPAM().AutoAssign(ctx, ipam.AutoAssignArgs{
+		Num4:        1,
+		HandleID:    &handle,
+		Attrs:       attrs,
+		Hostname:    conf.ipamHostname(nodename),
+		IPv4Pools:   cidrs,
+		IntendedUse: api.IPPoolAllowedUseTunnel,
+	})
+	if err != nil {
+		logCtx.WithError(err).Info("Unable to auto-assign a tunnel address for the node, trying its deterministic address")
+		if v4Assignments = assignDeterministicAddr(ctx, c, nodename, conf.ipamHostname(nodename), cidrs, handle, attrs, logCtx); v4Assignments == nil {
+			return "", false, ErrDatastoreUnavailable{Operation: "autoassign tunnel address", Err: err}
+		}
+	}
+	if err := checkAssignments(v4Assignments, 1); err != nil {
+		return "", false, err
+	}
+
+	ip := v4Assignments.IPs[0].IP.String()
+	logCtx.WithFields(log.Fields{"IP": ip, "handle": handle}).Info("Reserved tunnel address for the node")
+	return ip, true, nil
+}
+
+// reservationPools returns the CIDRs of the pools to reserve a tunnel address from: the named pool, or else the pools
+// enabled for the type. The node may not exist yet, so the pools' node selectors are evaluated against a node with no
+// labels. Name the pool if the pools select nodes by label.
+func reservationPools(ctx context.Context, c client.Interface, nodename, attrType, poolName string) ([]net.IPNet, error) {
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, ErrDatastoreUnavailable{Operation: "list IP pools", Err: err}
+	}
+	if poolName == "" {
+		node := libapi.NewNode()
+		node.Name = nodename
+		return determineEnabledPoolCIDRs(*node, *ipPoolList, attrType), nil
+	}
+	for _, ipPool := range ipPoolList.Items {
+		if ipPool.Name != poolName {
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(ipPool.Spec.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR for IP pool '%s': %w", poolName, err)
+		}
+		return []net.IPNet{*cidr}, nil
+	}
+	return nil, fmt.Errorf("IP pool '%s' not found", poolName)
+}
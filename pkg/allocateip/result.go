@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"sync"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// TunnelAddrResult describes what happened to a node's tunnel address of a particular type.
+type TunnelAddrResult string
+
+const (
+	// ResultNoChange means the tunnel address was left as it was, including when there was none.
+	ResultNoChange TunnelAddrResult = "NoChange"
+
+	// ResultAssigned means a tunnel address was assigned where there was none.
+	ResultAssigned TunnelAddrResult = "Assigned"
+
+	// ResultReassigned means the tunnel address was replaced with a different one.
+	ResultReassigned TunnelAddrResult = "Reassigned"
+
+	// ResultRemoved means the tunnel address was removed.
+	ResultRemoved TunnelAddrResult = "Removed"
+)
+
+// newTunnelAddrResult returns the result of a tunnel address changing from before to after.
+func newTunnelAddrResult(before, after string) TunnelAddrResult {
+	switch {
+	case before == after:
+		return ResultNoChange
+	case before == "":
+		return ResultAssigned
+	case after == "":
+		return ResultRemoved
+	}
+	return ResultReassigned
+}
+
+// anyChanged returns whether any of the results is a change.
+func anyChanged(results map[string]TunnelAddrResult) bool {
+	for _, r := range results {
+		if r != ResultNoChange {
+			return true
+		}
+	}
+	return false
+}
+
+// getTunnelAddrResults re-reads the node and returns the result for each of the tunnel address types, compared with
+// the node as it was before.
+func getTunnelAddrResults(ctx context.Context, c client.Interface, conf *Config, before *libapi.Node, attrTypes []string) (map[string]TunnelAddrResult, error) {
+	after, err := c.Nodes().Get(ctx, before.Name, options.GetOptions{})
+	if err != nil {
+		return nil, nodeOperationError("get", before.Name, err)
+	}
+	results := map[string]TunnelAddrResult{}
+	for _, attrType := range attrTypes {
+		field := conf.tunnelAddrFields(attrType)[0]
+		results[attrType] = newTunnelAddrResult(getTunnelAddrField(before, field), getTunnelAddrField(after, field))
+	}
+	return results, nil
+}
+
+// ReassignmentReason describes why a tunnel address was reassigned because it was no longer within an enabled pool.
+type ReassignmentReason string
+
+const (
+	// ReasonPoolDeleted means no pool contains the address, because its pool was deleted or its CIDR changed.
+	ReasonPoolDeleted ReassignmentReason = "PoolDeleted"
+
+	// ReasonPoolDisabled means the pool containing the address is disabled.
+	ReasonPoolDisabled ReassignmentReason = "PoolDisabled"
+
+	// ReasonEncapDisabled means the pool containing the address no longer has the encapsulation of the tunnel type
+	// enabled.
+	ReasonEncapDisabled ReassignmentReason = "EncapsulationDisabled"
+
+	// ReasonPoolExcluded means the pool containing the address is enabled, but may no longer be used for the node's
+	// tunnel addresses, e.g. because of its node selector, its allowed uses or the tunnel address pool configuration.
+	ReasonPoolExcluded ReassignmentReason = "PoolExcluded"
+
+	// ReasonUnknown means the pools could not be listed to determine the reason.
+	ReasonUnknown ReassignmentReason = "Unknown"
+)
+
+// getReassignmentReason returns why the address is no longer within one of the enabled pools for the tunnel type.
+func getReassignmentReason(ctx context.Context, c client.Interface, addr, attrType string) ReassignmentReason {
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		getLogger(ctx, attrType).WithError(err).Warn("Failed to list IP pools to determine the reassignment reason")
+		return ReasonUnknown
+	}
+	return reassignmentReason(*ipPoolList, addr, attrType)
+}
+
+// reassignmentReason returns why the address is no longer within one of the enabled pools for the tunnel type, by
+// comparing it against the full pool list, including the disabled pools.
+func reassignmentReason(ipPoolList api.IPPoolList, addr, attrType string) ReassignmentReason {
+	for _, ipPool := range ipPoolList.Items {
+		_, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR)
+		if err != nil || !isIpInPool(addr, []net.IPNet{*poolCidr}) {
+			continue
+		}
+		switch {
+		case ipPool.Spec.Disabled:
+			return ReasonPoolDisabled
+		case attrType == ipam.AttributeTypeIPIP && ipPool.Spec.IPIPMode != api.IPIPModeAlways && ipPool.Spec.IPIPMode != api.IPIPModeCrossSubnet:
+			return ReasonEncapDisabled
+		case attrType == ipam.AttributeTypeVXLAN && ipPool.Spec.VXLANMode != api.VXLANModeAlways && ipPool.Spec.VXLANMode != api.VXLANModeCrossSubnet:
+			return ReasonEncapDisabled
+		}
+		return ReasonPoolExcluded
+	}
+	return ReasonPoolDeleted
+}
+
+// reassignmentReasons collects the reason each type of tunnel address was reassigned during a run, for the run summary.
+type reassignmentReasons struct {
+	lock    sync.Mutex
+	reasons map[string]ReassignmentReason
+}
+
+// reassignmentReasonsKey is the context key for the reassignment reasons.
+type reassignmentReasonsKey struct{}
+
+// withReassignmentReasons returns a copy of the context that collects the reasons added with addReassignmentReason.
+func withReassignmentReasons(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reassignmentReasonsKey{}, &reassignmentReasons{reasons: map[string]ReassignmentReason{}})
+}
+
+// addReassignmentReason records the reason the tunnel address type was reassigned, if the context is collecting them.
+func addReassignmentReason(ctx context.Context, attrType string, reason ReassignmentReason) {
+	if r, ok := ctx.Value(reassignmentReasonsKey{}).(*reassignmentReasons); ok {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.reasons[attrType] = reason
+	}
+}
+
+// getReassignmentReasons returns the reasons recorded in the context so far.
+func getReassignmentReasons(ctx context.Context) map[string]ReassignmentReason {
+	reasons := map[string]ReassignmentReason{}
+	if r, ok := ctx.Value(reassignmentReasonsKey{}).(*reassignmentReasons); ok {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for attrType, reason := range r.reasons {
+			reasons[attrType] = reason
+		}
+	}
+	return reasons
+}
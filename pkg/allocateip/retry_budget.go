@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retryBudget bounds the total time spent waiting between retries across all of the operations of a reconcile, so
+// that the retries for each tunnel type do not add up to an unbounded delay.
+type retryBudget struct {
+	lock      sync.Mutex
+	total     time.Duration
+	remaining time.Duration
+}
+
+// retryBudgetKey is the context key for the retry budget.
+type retryBudgetKey struct{}
+
+// withRetryBudget returns a copy of the context carrying a retry budget of the supplied duration. A zero duration
+// leaves the context unchanged, so that retries are unbounded.
+func withRetryBudget(ctx context.Context, d time.Duration) context.Context {
+	if d == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, retryBudgetKey{}, &retryBudget{total: d, remaining: d})
+}
+
+// retrySleep waits before retrying an operation that failed with lastErr, deducting the wait from the context's
+// retry budget if it has one. If the budget cannot cover the wait, ErrRetryBudgetExhausted is returned immediately.
+func retrySleep(ctx context.Context, d time.Duration, lastErr error) error {
+	if b, ok := ctx.Value(retryBudgetKey{}).(*retryBudget); ok {
+		b.lock.Lock()
+		if b.remaining < d {
+			b.lock.Unlock()
+			return ErrRetryBudgetExhausted{Budget: b.total, Err: lastErr}
+		}
+		b.remaining -= d
+		b.lock.Unlock()
+	}
+	return sleepCtx(ctx, d)
+}
+
+// retryFields returns the log fields describing a retry after the failed attempt, counted from 1, out of the maximum
+// number of attempts, and the time elapsed since the first attempt started, so that it is clear how close the
+// operation is to giving up.
+func retryFields(ctx context.Context, attempt, maxAttempts int, start time.Time) log.Fields {
+	return log.Fields{
+		"attempt": fmt.Sprintf("%d/%d", attempt, maxAttempts),
+		"elapsed": getClock(ctx).Now().Sub(start).Round(time.Millisecond).String(),
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// AttributeTypeSelfTest is the IPAM allocation type of the throwaway addresses assigned by the selftest command, which
+// is distinct from the tunnel address types so that they are never mistaken for tunnel addresses.
+const AttributeTypeSelfTest = "selfTestAddress"
+
+// selftestResult is the outcome of a successful self-test round-trip.
+type selftestResult struct {
+	Addr            string
+	Handle          string
+	AssignDuration  time.Duration
+	ReleaseDuration time.Duration
+}
+
+// runSelftestCommand assigns and releases a throwaway address to check that the datastore is reachable and that the
+// allocator has the IPAM permissions it needs, without touching the node's tunnel addresses. It exits non-zero if
+// either step fails.
+func runSelftestCommand(conf *Config, nodename string, args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	node := fs.String("node", nodename, "Name of the node to assign the test address to")
+	pool := fs.String("pool", "", "Name of the IP pool to assign the test address from, defaults to any enabled pool")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *node == "" {
+		fmt.Fprintln(os.Stderr, "NODENAME environment is not set, use --node")
+		return 1
+	}
+
+	_, c := createClient(conf)
+	result, err := selftest(context.Background(), c, conf, *node, *pool)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Self-test failed: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Assigned %s with handle %s in %s\n", result.Addr, result.Handle, result.AssignDuration)
+	fmt.Printf("Released %s in %s\n", result.Addr, result.ReleaseDuration)
+	fmt.Println("Self-test passed")
+	return 0
+}
+
+// selftest assigns an address to the node under a throwaway handle, from the named pool if there is one, and then
+// releases it by the handle. As for any assignment, IPAM may claim a block affinity for the node, which is left in
+// place. If the release fails, the error names the handle so that the address can be released manually.
+func selftest(ctx context.Context, c client.Interface, conf *Config, nodename, poolName string) (selftestResult, error) {
+	var pools []net.IPNet
+	if poolName != "" {
+		ipPool, err := c.IPPools().Get(ctx, poolName, options.GetOptions{})
+		if err != nil {
+			return selftestResult{}, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get IP pool '%s'", poolName), Err: err}
+		}
+		_, cidr, err := net.ParseCIDR(ipPool.Spec.CIDR)
+		if err != nil {
+			return selftestResult{}, fmt.Errorf("invalid CIDR for IP pool '%s': %w", poolName, err)
+		}
+		pools = []net.IPNet{*cidr}
+	}
+
+	result := selftestResult{Handle: fmt.Sprintf("selftest-%s-%s", nodename, newRunID())}
+	start := getClock(ctx).Now()
+	v4Assignments, _, err := c.IPAM().AutoAssign(ctx, ipam.AutoAssignArgs{
+		Num4:      1,
+		HandleID:  &result.Handle,
+		Attrs:     map[string]string{ipam.AttributeNode: nodename, ipam.AttributeType: AttributeTypeSelfTest},
+		Hostname:  conf.ipamHostname(nodename),
+		IPv4Pools: pools,
+	})
+	result.AssignDuration = getClock(ctx).Now().Sub(start)
+	if err != nil {
+		return result, ErrDatastoreUnavailable{Operation: "autoassign test address", Err: err}
+	} else if err := checkAssignments(v4Assignments, 1); err != nil {
+		return result, err
+	}
+	result.Addr = v4Assignments.IPs[0].IP.String()
+
+	start = getClock(ctx).Now()
+	err = c.IPAM().ReleaseByHandle(ctx, result.Handle)
+	result.ReleaseDuration = getClock(ctx).Now().Sub(start)
+	if err != nil {
+		return result, ErrDatastoreUnavailable{Operation: fmt.Sprintf("release handle '%s'", result.Handle), Err: err}
+	}
+	if ips, err := c.IPAM().IPsByHandle(ctx, result.Handle); err == nil && len(ips) > 0 {
+		return result, fmt.Errorf("test address is still allocated with handle '%s' after release", result.Handle)
+	}
+	return result, nil
+}
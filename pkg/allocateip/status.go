@@ -0,0 +1,181 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// tunnelAttrTypes are the tunnel address types managed by the allocator.
+var tunnelAttrTypes = []string{ipam.AttributeTypeIPIP, ipam.AttributeTypeVXLAN, ipam.AttributeTypeWireguard}
+
+// tunnelAddrStatus is the status of a single tunnel address of a node.
+type tunnelAddrStatus struct {
+	Node    string `json:"node"`
+	Type    string `json:"type"`
+	Address string `json:"address"`
+
+	// InPool is true if the address is within one of the pools that a reconcile would assign the tunnel type on the
+	// node from.
+	InPool bool `json:"inPool"`
+
+	// Allocated is true if IPAM has the address allocated as a tunnel address of this type for the node.
+	Allocated bool `json:"allocated"`
+}
+
+// runStatusCommand prints the tunnel addresses of the node, or all nodes, as a table or JSON.
+func runStatusCommand(conf *Config, nodename string, args []string) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	all := fs.Bool("all", false, "Show the tunnel addresses of all nodes")
+	output := fs.String("output", "table", "Output format, one of: table, json")
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Invalid output format %q\n", *output)
+		return 1
+	}
+	if !*all && nodename == "" {
+		fmt.Fprintln(os.Stderr, "NODENAME environment is not set, use --node or --all")
+		return 1
+	}
+
+	_, c := createClient(conf)
+	ctx := context.Background()
+
+	var nodes []libapi.Node
+	if *all {
+		nodeList, err := c.Nodes().List(ctx, options.ListOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list nodes: %v\n", err)
+			return 1
+		}
+		nodes = nodeList.Items
+	} else {
+		node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get node '%s': %v\n", nodename, err)
+			return 1
+		}
+		nodes = []libapi.Node{*node}
+	}
+
+	statuses, err := getTunnelAddrStatuses(ctx, c, conf, nodes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to get tunnel address status: %v\n", err)
+		return 1
+	}
+
+	if *output == "json" {
+		err = writeStatusJSON(os.Stdout, statuses)
+	} else {
+		err = writeStatusTable(os.Stdout, statuses)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write output: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// getTunnelAddrStatuses returns the status of each tunnel address type of each of the supplied nodes, reading each
+// address from the node field configured for its type.
+func getTunnelAddrStatuses(ctx context.Context, c client.Interface, conf *Config, nodes []libapi.Node) ([]tunnelAddrStatus, error) {
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, ErrDatastoreUnavailable{Operation: "list IP pools", Err: err}
+	}
+
+	statuses := []tunnelAddrStatus{}
+	for i := range nodes {
+		node := &nodes[i]
+		// Index the pools as a reconcile would, so that an address reported as in a pool is one that is kept.
+		nodePools, err := constrainTunnelAddrPools(ctx, c, node, ipPoolList)
+		if err != nil {
+			return nil, err
+		}
+		pools := tunnelPoolIndex(ctx, conf, *node, *nodePools)
+		for _, attrType := range tunnelAttrTypes {
+			status := tunnelAddrStatus{
+				Node:    node.Name,
+				Type:    attrType,
+				Address: getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0]),
+			}
+			if status.Address != "" {
+				cidrs := pools[attrType]
+				if sub, err := conf.constrainToSubCIDR(cidrs); err == nil {
+					cidrs = sub
+				}
+				status.InPool = isIpInPool(status.Address, cidrs)
+				if status.Allocated, err = isTunnelAddrAllocated(ctx, c, node.Name, status.Address, attrType); err != nil {
+					return nil, err
+				}
+			}
+			statuses = append(statuses, status)
+		}
+	}
+	return statuses, nil
+}
+
+// isTunnelAddrAllocated returns whether IPAM has the address allocated as a tunnel address of the specified type
+// for the node.
+func isTunnelAddrAllocated(ctx context.Context, c client.Interface, nodename, addr, attrType string) (bool, error) {
+	ipAddr := net.ParseIP(addr)
+	if ipAddr == nil {
+		return false, nil
+	}
+	attr, _, err := c.IPAM().GetAssignmentAttributes(ctx, *ipAddr)
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+			return false, nil
+		}
+		return false, ErrDatastoreUnavailable{Operation: fmt.Sprintf("get assignment attributes for '%s'", addr), Err: err}
+	}
+	return attr[ipam.AttributeType] == attrType && attr[ipam.AttributeNode] == nodename, nil
+}
+
+// writeStatusTable writes the tunnel address statuses as a human readable table.
+func writeStatusTable(w io.Writer, statuses []tunnelAddrStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tTYPE\tADDRESS\tIN POOL\tALLOCATED")
+	for _, s := range statuses {
+		addr := s.Address
+		if addr == "" {
+			addr = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%t\t%t\n", s.Node, s.Type, addr, s.InPool, s.Allocated)
+	}
+	return tw.Flush()
+}
+
+// writeStatusJSON writes the tunnel address statuses as JSON.
+func writeStatusJSON(w io.Writer, statuses []tunnelAddrStatus) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(statuses)
+}
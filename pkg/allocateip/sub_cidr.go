@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	gnet "net"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	log "github.com/sirupsen/logrus"
+)
+
+// parseSubCIDR parses the configured tunnel address sub-CIDR, checking that it is an IPv4 CIDR small enough to assign
+// from one address at a time.
+func parseSubCIDR(value string) (*net.IPNet, error) {
+	_, sub, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tunnel address sub-CIDR '%s': %w", value, err)
+	} else if sub.Version() != 4 {
+		return nil, fmt.Errorf("tunnel address sub-CIDR '%s' is not an IPv4 CIDR", value)
+	} else if ones, _ := sub.Mask.Size(); ones < minIPv4BlockSize {
+		return nil, fmt.Errorf("tunnel address sub-CIDR '%s' is larger than a /%d", value, minIPv4BlockSize)
+	}
+	return sub, nil
+}
+
+// constrainToSubCIDR returns the configured sub-CIDR in place of the supplied pools if it is within one of them, so
+// that tunnel addresses are only assigned from, and are only valid within, that range. If no sub-CIDR is configured,
+// the pools are returned unchanged, and if it is not within any of the pools, ErrSubCIDRNotInPool is returned.
+func (conf *Config) constrainToSubCIDR(cidrs []net.IPNet) ([]net.IPNet, error) {
+	if conf.TunnelAddrSubCIDR == "" {
+		return cidrs, nil
+	}
+	sub, err := parseSubCIDR(conf.TunnelAddrSubCIDR)
+	if err != nil {
+		return nil, err
+	}
+	subOnes, _ := sub.Mask.Size()
+	for _, cidr := range cidrs {
+		if ones, _ := cidr.Mask.Size(); cidr.Version() == 4 && ones <= subOnes && cidr.Contains(sub.IP) {
+			return []net.IPNet{*sub}, nil
+		}
+	}
+	return nil, ErrSubCIDRNotInPool{SubCIDR: sub.String(), Pools: cidrs}
+}
+
+// assignSubCIDRAddr assigns the first free address in the sub-CIDR to the host, trying each address in turn. The
+// sub-CIDR is not a pool, so AutoAssign cannot be restricted to it. It returns nil if no address could be assigned.
+func assignSubCIDRAddr(ctx context.Context, c client.Interface, sub net.IPNet, host, handle string, attrs map[string]string, logCtx *log.Entry) (*ipam.IPAMAssignments, error) {
+	ones, bits := sub.Mask.Size()
+	ip := net.IP{IP: sub.IP.Mask(sub.Mask)}
+	for i := 0; i < 1<<uint(bits-ones); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		args := ipam.AssignIPArgs{
+			IP:       ip,
+			HandleID: &handle,
+			Attrs:    attrs,
+			Hostname: host,
+		}
+		err := c.IPAM().AssignIP(ctx, args)
+		if err == nil {
+			return &ipam.IPAMAssignments{
+				IPs:          []net.IPNet{{IPNet: gnet.IPNet{IP: ip.IP, Mask: gnet.CIDRMask(32, 32)}}},
+				IPVersion:    4,
+				NumRequested: 1,
+			}, nil
+		}
+		logCtx.WithError(err).WithField("IP", ip).Debug("Unable to assign address in the tunnel address sub-CIDR")
+		ip = net.IncrementIP(ip, big.NewInt(1))
+	}
+	return nil, nil
+}
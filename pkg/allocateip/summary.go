@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/options"
+	log "github.com/sirupsen/logrus"
+)
+
+// runWarnings collects the non-fatal warnings encountered during a run, for the run summary.
+type runWarnings struct {
+	lock     sync.Mutex
+	warnings []string
+}
+
+// runWarningsKey is the context key for the run warnings.
+type runWarningsKey struct{}
+
+// withRunWarnings returns a copy of the context that collects the warnings added with addRunWarning.
+func withRunWarnings(ctx context.Context) (context.Context, *runWarnings) {
+	w := &runWarnings{}
+	return context.WithValue(ctx, runWarningsKey{}, w), w
+}
+
+// addRunWarning records a non-fatal warning for the run summary, if the context is collecting them.
+func addRunWarning(ctx context.Context, format string, args ...interface{}) {
+	if w, ok := ctx.Value(runWarningsKey{}).(*runWarnings); ok {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		w.warnings = append(w.warnings, fmt.Sprintf(format, args...))
+	}
+}
+
+// list returns the warnings recorded so far.
+func (w *runWarnings) list() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]string{}, w.warnings...)
+}
+
+// summaryFields returns the log fields summarizing a run: the final address of each tunnel type, or "none", with its
+// result and the reason for any reassignment, whether anything changed, the number of addresses held by each of the
+// node's tunnel address handles, and the warnings encountered.
+func summaryFields(ctx context.Context, c client.Interface, conf *Config, nodename string, results map[string]TunnelAddrResult, warnings []string) log.Fields {
+	fields := log.Fields{
+		"node":     nodename,
+		"changed":  anyChanged(results),
+		"warnings": warnings,
+	}
+	node, err := c.Nodes().Get(ctx, nodename, options.GetOptions{})
+	reasons := getReassignmentReasons(ctx)
+	for attrType, result := range results {
+		addr := "unknown"
+		if err == nil {
+			if addr = getTunnelAddrField(node, conf.tunnelAddrFields(attrType)[0]); addr == "" {
+				addr = "none"
+			}
+		}
+		if reason, ok := reasons[attrType]; ok && result == ResultReassigned {
+			fields[attrType] = fmt.Sprintf("%s (%s: %s)", addr, result, reason)
+			continue
+		}
+		fields[attrType] = fmt.Sprintf("%s (%s)", addr, result)
+	}
+	if counts, err := handleAddrCounts(ctx, c, nodename); err == nil {
+		fields["handleAddrs"] = counts
+	} else {
+		fields["handleAddrs"] = "unknown"
+	}
+	return fields
+}
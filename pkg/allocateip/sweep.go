@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// sweepLimits bound the load that a cluster-wide sweep puts on the datastore. The zero value processes every item in
+// turn, in a single batch, without throttling.
+type sweepLimits struct {
+	// Concurrency is the maximum number of items processed at once.
+	Concurrency int
+
+	// MaxQPS is the maximum rate of datastore requests across the whole sweep, or zero for no limit.
+	MaxQPS float64
+
+	// BatchSize is the number of items in each batch, or zero for a single batch. Each batch is finished before the
+	// next is started, and the sweep stops after the first batch with a failure.
+	BatchSize int
+}
+
+// validate returns an error if any of the limits is negative.
+func (l sweepLimits) validate() error {
+	if l.Concurrency < 0 || l.MaxQPS < 0 || l.BatchSize < 0 {
+		return fmt.Errorf("concurrency, max QPS and batch size must not be negative")
+	}
+	return nil
+}
+
+// sweepBatches calls process for each of the items, in batches, with at most the configured number of calls in
+// progress at once. The throttle is passed to process, and should be waited on before each datastore request. It
+// returns the number of leading items that were all processed successfully, so that an interrupted sweep of sorted
+// items can be resumed after the last of them, and the first error of the first batch that failed.
+func sweepBatches(ctx context.Context, limits sweepLimits, throttle *sweepThrottle, items []string, process func(context.Context, *sweepThrottle, string) error) (int, error) {
+	done := make([]bool, len(items))
+	completed := func() int {
+		n := 0
+		for n < len(done) && done[n] {
+			n++
+		}
+		return n
+	}
+
+	concurrency := limits.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	batchSize := limits.BatchSize
+	if batchSize < 1 || batchSize > len(items) {
+		batchSize = len(items)
+	}
+
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+		getLogger(ctx, "").WithField("items", fmt.Sprintf("%d-%d of %d", start+1, end, len(items))).Debug("Processing sweep batch")
+
+		g, gctx := errgroup.WithContext(ctx)
+		sem := make(chan struct{}, concurrency)
+		for i, item := range items[start:end] {
+			i, item := start+i, item
+			select {
+			case sem <- struct{}{}:
+			case <-gctx.Done():
+			}
+			if gctx.Err() != nil {
+				break
+			}
+			g.Go(func() error {
+				defer func() { <-sem }()
+				if err := process(gctx, throttle, item); err != nil {
+					return err
+				}
+				done[i] = true
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return completed(), err
+		}
+		if err := ctx.Err(); err != nil {
+			return completed(), err
+		}
+	}
+	return len(items), nil
+}
+
+// sweepThrottle spaces out the datastore requests of a sweep so that they do not exceed a maximum rate. A nil
+// sweepThrottle does not throttle.
+type sweepThrottle struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newSweepThrottle returns a sweepThrottle for the supplied maximum rate, or nil if there is no maximum.
+func newSweepThrottle(maxQPS float64) *sweepThrottle {
+	if maxQPS <= 0 {
+		return nil
+	}
+	return &sweepThrottle{interval: time.Duration(float64(time.Second) / maxQPS)}
+}
+
+// wait waits until the next request may be made, returning the context error early if the context is done first.
+func (t *sweepThrottle) wait(ctx context.Context) error {
+	if t == nil {
+		return ctx.Err()
+	}
+	clk := getClock(ctx)
+	t.lock.Lock()
+	now := clk.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.lock.Unlock()
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	return clk.Sleep(ctx, delay)
+}
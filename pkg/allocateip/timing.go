@@ -0,0 +1,184 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+	"time"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// defaultSlowOperationThreshold is the duration above which a datastore operation is logged as slow, if not
+// configured.
+const defaultSlowOperationThreshold = 2 * time.Second
+
+// defaultOperationTimeout bounds the duration of each datastore operation, if not configured.
+const defaultOperationTimeout = 30 * time.Second
+
+// timedClient wraps a client.Interface, timing the node, IP pool and IPAM operations made by the allocator. The
+// durations are recorded in a histogram, and operations that exceed the threshold are logged as slow. Each operation
+// is also bounded by the per-operation timeout, so that one slow call cannot use up the time of the whole run.
+type timedClient struct {
+	client.Interface
+	ipam    *timedIPAM
+	nodes   *timedNodes
+	ipPools *timedIPPools
+}
+
+func newTimedClient(c client.Interface, threshold, timeout time.Duration) *timedClient {
+	if threshold == 0 {
+		threshold = defaultSlowOperationThreshold
+	}
+	if timeout == 0 {
+		timeout = defaultOperationTimeout
+	}
+	limits := operationLimits{threshold: threshold, timeout: timeout}
+	return &timedClient{
+		Interface: c,
+		ipam:      &timedIPAM{Interface: c.IPAM(), limits: limits},
+		nodes:     &timedNodes{NodeInterface: c.Nodes(), limits: limits},
+		ipPools:   &timedIPPools{IPPoolInterface: c.IPPools(), limits: limits},
+	}
+}
+
+func (c *timedClient) IPAM() ipam.Interface {
+	return c.ipam
+}
+
+func (c *timedClient) Nodes() client.NodeInterface {
+	return c.nodes
+}
+
+func (c *timedClient) IPPools() client.IPPoolInterface {
+	return c.ipPools
+}
+
+// Backend returns the backend client of the wrapped client, or nil if it does not expose one.
+func (c *timedClient) Backend() bapi.Client {
+	if bc, ok := c.Interface.(backendClientAccessor); ok {
+		return bc.Backend()
+	}
+	return nil
+}
+
+// operationLimits are the slow operation threshold and timeout of the datastore operations made by a timedClient.
+type operationLimits struct {
+	threshold time.Duration
+	timeout   time.Duration
+}
+
+// start starts the named operation, returning its context, which is bounded by the per-operation timeout as well as
+// any earlier deadline of ctx, and a function to call with the operation's error once it completes. That records the
+// duration of the operation and logs it if it was slow, or if it failed because it timed out.
+func (l operationLimits) start(ctx context.Context, operation string) (context.Context, func(error)) {
+	start := time.Now()
+	opCtx, cancel := context.WithTimeout(ctx, l.timeout)
+	return opCtx, func(err error) {
+		defer cancel()
+		observeOperation(ctx, operation, start, l.threshold)
+		if err != nil && opCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			getLogger(ctx, "").WithError(err).WithField("operation", operation).Warnf("Datastore operation timed out after %s", l.timeout)
+		}
+	}
+}
+
+// observeOperation records the duration of the named operation since start, logging a warning if it exceeded the
+// threshold.
+func observeOperation(ctx context.Context, operation string, start time.Time, threshold time.Duration) {
+	d := time.Since(start)
+	histogramDatastoreOperationDuration.WithLabelValues(operation).Observe(d.Seconds())
+	if d > threshold {
+		getLogger(ctx, "").WithField("operation", operation).WithField("duration", d).Warnf("Slow datastore operation, exceeded %s", threshold)
+	}
+}
+
+// timedIPAM wraps an ipam.Interface, timing the operations used by the allocator.
+type timedIPAM struct {
+	ipam.Interface
+	limits operationLimits
+}
+
+func (t *timedIPAM) AutoAssign(ctx context.Context, args ipam.AutoAssignArgs) (v4, v6 *ipam.IPAMAssignments, err error) {
+	ctx, done := t.limits.start(ctx, "AutoAssign")
+	defer func() { done(err) }()
+	return t.Interface.AutoAssign(ctx, args)
+}
+
+func (t *timedIPAM) AssignIP(ctx context.Context, args ipam.AssignIPArgs) (err error) {
+	ctx, done := t.limits.start(ctx, "AssignIP")
+	defer func() { done(err) }()
+	return t.Interface.AssignIP(ctx, args)
+}
+
+func (t *timedIPAM) ReleaseIPs(ctx context.Context, ips []net.IP) (unallocated []net.IP, err error) {
+	ctx, done := t.limits.start(ctx, "ReleaseIPs")
+	defer func() { done(err) }()
+	return t.Interface.ReleaseIPs(ctx, ips)
+}
+
+func (t *timedIPAM) ReleaseByHandle(ctx context.Context, handleID string) (err error) {
+	ctx, done := t.limits.start(ctx, "ReleaseByHandle")
+	defer func() { done(err) }()
+	return t.Interface.ReleaseByHandle(ctx, handleID)
+}
+
+func (t *timedIPAM) IPsByHandle(ctx context.Context, handleID string) (ips []net.IP, err error) {
+	ctx, done := t.limits.start(ctx, "IPsByHandle")
+	defer func() { done(err) }()
+	return t.Interface.IPsByHandle(ctx, handleID)
+}
+
+func (t *timedIPAM) GetAssignmentAttributes(ctx context.Context, addr net.IP) (attrs map[string]string, handle *string, err error) {
+	ctx, done := t.limits.start(ctx, "GetAssignmentAttributes")
+	defer func() { done(err) }()
+	return t.Interface.GetAssignmentAttributes(ctx, addr)
+}
+
+// timedNodes wraps a client.NodeInterface, timing the operations used by the allocator.
+type timedNodes struct {
+	client.NodeInterface
+	limits operationLimits
+}
+
+func (t *timedNodes) Get(ctx context.Context, name string, opts options.GetOptions) (node *libapi.Node, err error) {
+	ctx, done := t.limits.start(ctx, "NodeGet")
+	defer func() { done(err) }()
+	return t.NodeInterface.Get(ctx, name, opts)
+}
+
+func (t *timedNodes) Update(ctx context.Context, res *libapi.Node, opts options.SetOptions) (node *libapi.Node, err error) {
+	ctx, done := t.limits.start(ctx, "NodeUpdate")
+	defer func() { done(err) }()
+	return t.NodeInterface.Update(ctx, res, opts)
+}
+
+// timedIPPools wraps a client.IPPoolInterface, timing the operations used by the allocator.
+type timedIPPools struct {
+	client.IPPoolInterface
+	limits operationLimits
+}
+
+func (t *timedIPPools) List(ctx context.Context, opts options.ListOptions) (list *api.IPPoolList, err error) {
+	ctx, done := t.limits.start(ctx, "IPPoolList")
+	defer func() { done(err) }()
+	return t.IPPoolInterface.List(ctx, opts)
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"errors"
+	"fmt"
+	gnet "net"
+	"reflect"
+	"strings"
+
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	log "github.com/sirupsen/logrus"
+)
+
+// The node fields that a tunnel address may be stored in. As well as the node spec fields, an address may be stored
+// in a node annotation by prefixing the annotation key with FieldAnnotationPrefix.
+const (
+	FieldIPIPTunnelAddr      = "spec.bgp.ipv4IPIPTunnelAddr"
+	FieldVXLANTunnelAddr     = "spec.ipv4VXLANTunnelAddr"
+	FieldWireguardTunnelAddr = "spec.wireguard.interfaceIPv4Address"
+	FieldAnnotationPrefix    = "metadata.annotations."
+)
+
+// AnnotationUserManagedTunnelAddrs is the node annotation listing the tunnel address types, as a comma separated list
+// of IPAM attribute types (e.g. "ipipTunnelAddress,vxlanTunnelAddress"), whose addresses are managed by the user. A
+// user-managed address is verified but is never released, reassigned or removed.
+const AnnotationUserManagedTunnelAddrs = "projectcalico.org/user-managed-tunnel-addrs"
+
+// The node annotations that tunnel addresses are stored in when Config.ExternalTunnelAddrProgramming is set. These form
+// the contract with the external agent that owns the canonical node spec fields:
+//
+//   - The allocator assigns the address in IPAM, with the usual handle and attributes, and records it in the
+//     annotation. It never reads or writes the canonical field.
+//   - The agent copies the address from the annotation to the canonical field, and programs the tunnel device.
+//   - When the address is reassigned, the annotation is updated in place. When it is removed, the annotation is
+//     deleted and the address released, and the agent must then clear the canonical field.
+const (
+	AnnotationIPIPTunnelAddr      = "projectcalico.org/ipip-tunnel-addr"
+	AnnotationVXLANTunnelAddr     = "projectcalico.org/vxlan-tunnel-addr"
+	AnnotationWireguardTunnelAddr = "projectcalico.org/wireguard-tunnel-addr"
+)
+
+// externalTunnelAddrFields maps each tunnel address type to the node field it is stored in by default when the tunnel
+// addresses are programmed externally.
+var externalTunnelAddrFields = map[string]string{
+	ipam.AttributeTypeIPIP:      FieldAnnotationPrefix + AnnotationIPIPTunnelAddr,
+	ipam.AttributeTypeVXLAN:     FieldAnnotationPrefix + AnnotationVXLANTunnelAddr,
+	ipam.AttributeTypeWireguard: FieldAnnotationPrefix + AnnotationWireguardTunnelAddr,
+}
+
+// defaultTunnelAddrFields maps each tunnel address type to the node field it is stored in by default.
+var defaultTunnelAddrFields = map[string]string{
+	ipam.AttributeTypeIPIP:      FieldIPIPTunnelAddr,
+	ipam.AttributeTypeVXLAN:     FieldVXLANTunnelAddr,
+	ipam.AttributeTypeWireguard: FieldWireguardTunnelAddr,
+}
+
+// tunnelAddrFields returns the node fields that the tunnel address of the specified type is stored in. The address is
+// read from the first field, and written to all of them.
+func (conf *Config) tunnelAddrFields(attrType string) []string {
+	if fields := conf.TunnelAddrFields[attrType]; len(fields) > 0 {
+		return fields
+	}
+	if conf.ExternalTunnelAddrProgramming {
+		return []string{externalTunnelAddrFields[attrType]}
+	}
+	return []string{defaultTunnelAddrFields[attrType]}
+}
+
+// validateTunnelAddrField returns an error if the field is not one that a tunnel address may be stored in.
+func validateTunnelAddrField(field string) error {
+	switch field {
+	case FieldIPIPTunnelAddr, FieldVXLANTunnelAddr, FieldWireguardTunnelAddr:
+		return nil
+	}
+	if strings.HasPrefix(field, FieldAnnotationPrefix) && len(field) > len(FieldAnnotationPrefix) {
+		return nil
+	}
+	return fmt.Errorf("unsupported tunnel address field '%s'", field)
+}
+
+// isCanonicalTunnelAddrField returns whether the field is one of the node spec fields that Felix reads tunnel addresses
+// from.
+func isCanonicalTunnelAddrField(field string) bool {
+	return !strings.HasPrefix(field, FieldAnnotationPrefix)
+}
+
+// isUserManagedTunnelAddr returns true if the node annotates the tunnel address of the specified type as user-managed.
+func isUserManagedTunnelAddr(node *libapi.Node, attrType string) bool {
+	for _, t := range strings.Split(node.Annotations[AnnotationUserManagedTunnelAddrs], ",") {
+		if strings.TrimSpace(t) == attrType {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeTunnelAddr returns the bare IP form of a tunnel address read from a node field. A CIDR suffix, e.g. in
+// "10.0.0.5/26", is sometimes written to the field by mistake, so the mask is stripped and the host part returned. A
+// bare IP is returned unchanged. An error is returned if the address cannot be parsed.
+func normalizeTunnelAddr(value string) (string, error) {
+	if strings.Contains(value, "/") {
+		ip, _, err := gnet.ParseCIDR(value)
+		if err != nil {
+			return "", err
+		}
+		return ip.String(), nil
+	}
+	if gnet.ParseIP(value) == nil {
+		return "", errors.New("failed to parse IP address")
+	}
+	return value, nil
+}
+
+// validateTunnelAddress checks that a tunnel address is fit to be written to the node: a bare IPv4 address literal, in
+// its canonical form, within one of the supplied pools. It is checked before every write so that a malformed value is
+// never persisted, since the other components reading the node fields are less tolerant than we are.
+func validateTunnelAddress(addr string, cidrs []net.IPNet) error {
+	ip := gnet.ParseIP(addr)
+	if ip == nil {
+		return ErrInvalidTunnelAddress{Addr: addr, Err: errors.New("not an IP address literal")}
+	} else if ip.To4() == nil {
+		return ErrAddressFamilyMismatch{Addr: addr, Requested: 4}
+	} else if canonical := ip.To4().String(); canonical != addr {
+		return ErrInvalidTunnelAddress{Addr: addr, Err: fmt.Errorf("not in canonical form, expected '%s'", canonical)}
+	} else if !isIpInPool(addr, cidrs) {
+		return ErrAddressNotInPool{Addr: addr, Pools: cidrs}
+	}
+	return nil
+}
+
+// getTunnelAddrField returns the tunnel address stored in the node field, or an empty string if there is none. Only
+// the IPIP address is stored in the BGP spec, which is nil when BGP is disabled, e.g. in VXLAN-only clusters. The other
+// fields never depend on the BGP spec, so a nil BGP spec only ever means there is no IPIP address.
+func getTunnelAddrField(node *libapi.Node, field string) string {
+	switch field {
+	case FieldVXLANTunnelAddr:
+		return node.Spec.IPv4VXLANTunnelAddr
+	case FieldIPIPTunnelAddr:
+		if node.Spec.BGP != nil {
+			return node.Spec.BGP.IPv4IPIPTunnelAddr
+		}
+	case FieldWireguardTunnelAddr:
+		if node.Spec.Wireguard != nil {
+			return node.Spec.Wireguard.InterfaceIPv4Address
+		}
+	default:
+		if strings.HasPrefix(field, FieldAnnotationPrefix) {
+			return node.Annotations[strings.TrimPrefix(field, FieldAnnotationPrefix)]
+		}
+	}
+	return ""
+}
+
+// setTunnelAddrField stores the tunnel address in the node field. An empty address clears the field, removing any
+// parent struct or annotation that is left empty as a result. The BGP spec is only created to store an IPIP address,
+// so assigning the other types of address never enables BGP on the node.
+func setTunnelAddrField(node *libapi.Node, field string, addr string) {
+	switch field {
+	case FieldVXLANTunnelAddr:
+		node.Spec.IPv4VXLANTunnelAddr = addr
+	case FieldIPIPTunnelAddr:
+		if node.Spec.BGP == nil {
+			if addr == "" {
+				return
+			}
+			node.Spec.BGP = &libapi.NodeBGPSpec{}
+		}
+		node.Spec.BGP.IPv4IPIPTunnelAddr = addr
+
+		// If removing the tunnel address causes the BGP spec to be empty, then nil it out.
+		// libcalico asserts that if a BGP spec is present, that it not be empty.
+		if reflect.DeepEqual(*node.Spec.BGP, libapi.NodeBGPSpec{}) {
+			log.Debug("BGP spec is now empty, setting to nil")
+			node.Spec.BGP = nil
+		}
+	case FieldWireguardTunnelAddr:
+		if node.Spec.Wireguard == nil {
+			if addr == "" {
+				return
+			}
+			node.Spec.Wireguard = &libapi.NodeWireguardSpec{}
+		}
+		node.Spec.Wireguard.InterfaceIPv4Address = addr
+
+		if reflect.DeepEqual(*node.Spec.Wireguard, libapi.NodeWireguardSpec{}) {
+			log.Debug("Wireguard spec is now empty, setting to nil")
+			node.Spec.Wireguard = nil
+		}
+	default:
+		if !strings.HasPrefix(field, FieldAnnotationPrefix) {
+			return
+		}
+		key := strings.TrimPrefix(field, FieldAnnotationPrefix)
+		if addr == "" {
+			delete(node.Annotations, key)
+			return
+		}
+		if node.Annotations == nil {
+			node.Annotations = map[string]string{}
+		}
+		node.Annotations[key] = addr
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"context"
+
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+)
+
+// TunnelIPAM is the IPAM used to assign and release tunnel addresses. The libcalico-go ipam.Interface satisfies it,
+// and is used by default, but an alternative may be supplied with NewAllocatorWithIPAM to assign tunnel addresses from
+// a different IPAM backend. The other IPAM operations made by the allocator, such as reading the allocation attributes
+// of an address, always use the Calico client.
+type TunnelIPAM interface {
+	// AutoAssign assigns addresses from the pools in the arguments, returning the IPv4 and IPv6 assignments.
+	AutoAssign(ctx context.Context, args ipam.AutoAssignArgs) (*ipam.IPAMAssignments, *ipam.IPAMAssignments, error)
+
+	// AssignIP assigns the specific address in the arguments.
+	AssignIP(ctx context.Context, args ipam.AssignIPArgs) error
+
+	// ReleaseByHandle releases all of the addresses assigned with the handle.
+	ReleaseByHandle(ctx context.Context, handleID string) error
+}
+
+var _ TunnelIPAM = ipam.Interface(nil)
+
+// tunnelIPAMClient wraps a client.Interface, routing the tunnel address assignment and release operations through a
+// TunnelIPAM.
+type tunnelIPAMClient struct {
+	client.Interface
+	ipam *tunnelIPAMInterface
+}
+
+func newTunnelIPAMClient(c client.Interface, tunnelIPAM TunnelIPAM) *tunnelIPAMClient {
+	return &tunnelIPAMClient{
+		Interface: c,
+		ipam:      &tunnelIPAMInterface{Interface: c.IPAM(), tunnel: tunnelIPAM},
+	}
+}
+
+func (c *tunnelIPAMClient) IPAM() ipam.Interface {
+	return c.ipam
+}
+
+// Backend returns the backend client of the wrapped client, or nil if it does not expose one.
+func (c *tunnelIPAMClient) Backend() bapi.Client {
+	if bc, ok := c.Interface.(backendClientAccessor); ok {
+		return bc.Backend()
+	}
+	return nil
+}
+
+// tunnelIPAMInterface wraps an ipam.Interface, replacing the operations of TunnelIPAM.
+type tunnelIPAMInterface struct {
+	ipam.Interface
+	tunnel TunnelIPAM
+}
+
+func (t *tunnelIPAMInterface) AutoAssign(ctx context.Context, args ipam.AutoAssignArgs) (*ipam.IPAMAssignments, *ipam.IPAMAssignments, error) {
+	return t.tunnel.AutoAssign(ctx, args)
+}
+
+func (t *tunnelIPAMInterface) AssignIP(ctx context.Context, args ipam.AssignIPArgs) error {
+	return t.tunnel.AssignIP(ctx, args)
+}
+
+func (t *tunnelIPAMInterface) ReleaseByHandle(ctx context.Context, handleID string) error {
+	return t.tunnel.ReleaseByHandle(ctx, handleID)
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2021 Tigera, Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package allocateip
+
+import (
+	"bytes"
+	"context"
+	"strings"
+
+	api "github.com/projectcalico/api/pkg/apis/projectcalico/v3"
+	libapi "github.com/projectcalico/libcalico-go/lib/apis/v3"
+	client "github.com/projectcalico/libcalico-go/lib/clientv3"
+	cerrors "github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipam"
+	"github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/options"
+)
+
+// AnnotationTunnelAddrPools restricts the pools that tunnel addresses are assigned from to those named in its value,
+// a comma separated list of IP pool names. It may be set on the default FelixConfiguration to apply cluster-wide, or
+// on a node to apply to that node only. The annotation on the node takes precedence over the one on the default
+// FelixConfiguration, and if neither is present tunnel addresses may be assigned from any of the enabled pools.
+//
+// Within the named pools, tunnel addresses are assigned according to the encapsulation and selectors of the pools as
+// usual. A tunnel address in a pool that is no longer named is released and reassigned, as if the pool were disabled.
+const AnnotationTunnelAddrPools = "projectcalico.org/tunnel-addr-pools"
+
+// AnnotationPreferNodeSubnet, when set to "true" on a node, prefers the pools that overlap the subnet of the node's
+// primary IPv4 address, from spec.bgp.ipv4Address, when assigning the node's tunnel addresses. This keeps the tunnel
+// endpoint in the same subnet as the host's primary interface where possible. It may be enabled for all nodes with
+// the PreferNodeSubnetPools configuration instead.
+const AnnotationPreferNodeSubnet = "projectcalico.org/tunnel-addr-prefer-node-subnet"
+
+// AnnotationManualReassignment, when set to "true" on a node, disables the automatic reassignment of the node's tunnel
+// addresses when they are no longer within an enabled pool, leaving the current addresses in place with a warning. An
+// address is still assigned automatically where there is none. Removing the annotation allows the pending
+// reassignments to go ahead. It may be enabled for all nodes with the ManualReassignment configuration instead.
+const AnnotationManualReassignment = "projectcalico.org/tunnel-addr-manual-reassignment"
+
+// isManualReassignment returns whether the automatic reassignment of the node's tunnel addresses is disabled, either
+// for all nodes or for this node by AnnotationManualReassignment.
+func isManualReassignment(conf *Config, node *libapi.Node) bool {
+	return conf.ManualReassignment || strings.ToLower(node.Annotations[AnnotationManualReassignment]) == "true"
+}
+
+// defaultFelixConfigurationName is the name of the cluster-wide FelixConfiguration.
+const defaultFelixConfigurationName = "default"
+
+// tunnelAddrPoolNames returns the names of the pools that tunnel addresses for the node may be assigned from, and the
+// source of the setting, or no names if tunnel addresses may be assigned from any pool.
+func tunnelAddrPoolNames(ctx context.Context, c client.Interface, node *libapi.Node) (names []string, source string, err error) {
+	if names := parsePoolNames(node.Annotations[AnnotationTunnelAddrPools]); len(names) > 0 {
+		return names, "node", nil
+	}
+
+	fc, err := c.FelixConfigurations().Get(ctx, defaultFelixConfigurationName, options.GetOptions{})
+	if err != nil {
+		if _, ok := err.(cerrors.ErrorResourceDoesNotExist); ok {
+			return nil, "", nil
+		}
+		return nil, "", ErrDatastoreUnavailable{Operation: "get default FelixConfiguration", Err: err}
+	}
+	if names := parsePoolNames(fc.Annotations[AnnotationTunnelAddrPools]); len(names) > 0 {
+		return names, "FelixConfiguration", nil
+	}
+	return nil, "", nil
+}
+
+// parsePoolNames parses a comma separated list of pool names, ignoring empty entries.
+func parsePoolNames(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// constrainTunnelAddrPools returns the pools in the list that tunnel addresses for the node may be assigned from, as
+// configured by AnnotationTunnelAddrPools.
+func constrainTunnelAddrPools(ctx context.Context, c client.Interface, node *libapi.Node, ipPoolList *api.IPPoolList) (*api.IPPoolList, error) {
+	names, source, err := tunnelAddrPoolNames(ctx, c, node)
+	if err != nil || len(names) == 0 {
+		return ipPoolList, err
+	}
+
+	logCtx := getLogger(ctx, "").WithField("source", source)
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+	constrained := &api.IPPoolList{}
+	for _, ipPool := range ipPoolList.Items {
+		if wanted[ipPool.Name] {
+			constrained.Items = append(constrained.Items, ipPool)
+			delete(wanted, ipPool.Name)
+		}
+	}
+	for name := range wanted {
+		logCtx.WithField("pool", name).Warn("Tunnel address pool does not exist")
+		addRunWarning(ctx, "tunnel address pool %s does not exist", name)
+	}
+	logCtx.WithField("pools", names).Debug("Restricted tunnel address assignment to the configured pools")
+	return constrained, nil
+}
+
+// tunnelPoolIndex returns the poolIndex for the node, replacing the pools discovered from the encapsulation of each
+// pool with the explicitly configured pools for the types that have them. The discovered pools are narrowed to those
+// tagged for the node's zone, if a zone label is configured and there are any, and then to the pool overlapping the
+// node's subnet, if preferred and there is one.
+func tunnelPoolIndex(ctx context.Context, conf *Config, node libapi.Node, ipPoolList api.IPPoolList) poolIndex {
+	idx := newPoolIndex(node, ipPoolList)
+	if conf.ZoneLabel != "" {
+		preferZonePools(ctx, conf.ZoneLabel, node, ipPoolList, idx)
+	}
+	if conf.PreferNodeSubnetPools || strings.ToLower(node.Annotations[AnnotationPreferNodeSubnet]) == "true" {
+		preferNodeSubnetPool(ctx, node, idx)
+	}
+	for attrType, names := range conf.TunnelAddrPools {
+		if len(names) == 0 {
+			continue
+		}
+		if cidrs := explicitPoolCIDRs(ctx, node, ipPoolList, attrType, names); len(cidrs) > 0 {
+			idx[attrType] = cidrs
+		} else {
+			delete(idx, attrType)
+		}
+	}
+	return idx
+}
+
+// listTunnelPools lists the IP pools that the node's tunnel addresses may be assigned from, returning them along with
+// their poolIndex. If configured, the IPv4 pools override replaces the indexed pools.
+func listTunnelPools(ctx context.Context, c client.Interface, conf *Config, node *libapi.Node) (*api.IPPoolList, poolIndex, error) {
+	ipPoolList, err := c.IPPools().List(ctx, options.ListOptions{})
+	if err != nil {
+		return nil, nil, ErrDatastoreUnavailable{Operation: "list IP pools", Err: err}
+	}
+	if ipPoolList, err = constrainTunnelAddrPools(ctx, c, node, ipPoolList); err != nil {
+		return nil, nil, err
+	}
+
+	// Index the enabled pools by tunnel type, so that we only process the pool list once.
+	pools := tunnelPoolIndex(ctx, conf, *node, *ipPoolList)
+	if len(conf.IPv4PoolsOverride) > 0 {
+		getLogger(ctx, "").WithField("pools", conf.IPv4PoolsOverride).Warn("Overriding the tunnel address pools for this run")
+		pools = pools.override(conf.IPv4PoolsOverride)
+	}
+	return ipPoolList, pools, nil
+}
+
+// explicitPoolCIDRs returns the CIDRs of the named pools that a tunnel address of the specified type may be assigned
+// from, regardless of their encapsulation. A named pool that cannot be used, as described by explicitPoolProblem, is
+// skipped with a warning. As for discovered pools, wireguard addresses are only assigned once the node has a wireguard
+// public key.
+func explicitPoolCIDRs(ctx context.Context, node libapi.Node, ipPoolList api.IPPoolList, attrType string, names []string) []net.IPNet {
+	if attrType == ipam.AttributeTypeWireguard && node.Status.WireguardPublicKey == "" {
+		return nil
+	}
+	var cidrs []net.IPNet
+	for _, name := range names {
+		if problem := explicitPoolProblem(node, ipPoolList, name); problem != "" {
+			getLogger(ctx, attrType).WithField("pool", name).Warnf("Configured tunnel address pool %s, skipping", problem)
+			addRunWarning(ctx, "%s: configured tunnel address pool %s %s", attrType, name, problem)
+			continue
+		}
+		for _, ipPool := range ipPoolList.Items {
+			if ipPool.Name == name {
+				_, poolCidr, _ := net.ParseCIDR(ipPool.Spec.CIDR)
+				cidrs = append(cidrs, *poolCidr)
+			}
+		}
+	}
+	return cidrs
+}
+
+// explicitPoolProblem returns why the named pool cannot be used for the node's tunnel addresses, or an empty string if
+// it can: the pool must exist, be an enabled IPv4 pool, select the node and allow tunnel use.
+func explicitPoolProblem(node libapi.Node, ipPoolList api.IPPoolList, name string) string {
+	for _, ipPool := range ipPoolList.Items {
+		if ipPool.Name != name {
+			continue
+		}
+		if _, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR); err != nil || poolCidr.Version() != 4 {
+			return "is not a valid IPv4 pool"
+		}
+		if ipPool.Spec.Disabled {
+			return "is disabled"
+		}
+		if selects, err := ipam.SelectsNode(ipPool, node); err != nil || !selects {
+			return "does not select the node"
+		}
+		if allowed, _ := tunnelPoolUse(ipPool); !allowed {
+			return "does not allow tunnel use"
+		}
+		return ""
+	}
+	return "does not exist"
+}
+
+// preferZonePools narrows the pools of each type in the index to those tagged for the node's zone, i.e. those with the
+// same value as the node for the zone label, if there are any. Otherwise the type keeps all of its eligible pools. An
+// address assigned from a fallback pool is reassigned once a pool is tagged for the node's zone, as for any address
+// that is no longer in one of the usable pools.
+func preferZonePools(ctx context.Context, zoneLabel string, node libapi.Node, ipPoolList api.IPPoolList, idx poolIndex) {
+	zone := node.Labels[zoneLabel]
+	if zone == "" {
+		getLogger(ctx, "").WithField("label", zoneLabel).Debug("Node has no zone label, not preferring zone pools")
+		return
+	}
+	zonePools := map[string]string{}
+	for _, ipPool := range ipPoolList.Items {
+		if ipPool.Labels[zoneLabel] == zone {
+			if _, poolCidr, err := net.ParseCIDR(ipPool.Spec.CIDR); err == nil {
+				zonePools[poolCidr.String()] = ipPool.Name
+			}
+		}
+	}
+
+	for attrType, cidrs := range idx {
+		logCtx := getLogger(ctx, attrType).WithField("zone", zone)
+		var preferred []net.IPNet
+		var names []string
+		for _, cidr := range cidrs {
+			if name, ok := zonePools[cidr.String()]; ok {
+				preferred = append(preferred, cidr)
+				names = append(names, name)
+			}
+		}
+		if len(preferred) == 0 {
+			logCtx.Debug("No tunnel address pools are tagged for the node's zone, using any eligible pool")
+			continue
+		}
+		logCtx.WithField("pools", names).Debug("Using the tunnel address pools tagged for the node's zone")
+		idx[attrType] = preferred
+	}
+}
+
+// preferNodeSubnetPool narrows the pools of each type in the index to a single pool that overlaps the subnet of the
+// node's primary IPv4 address, if there is one. If several overlap, the most specific is chosen, breaking ties by the
+// lowest CIDR, so that the choice is the same on every reconcile. If none overlap, or the node's subnet is not known,
+// the type keeps all of its eligible pools with a warning.
+func preferNodeSubnetPool(ctx context.Context, node libapi.Node, idx poolIndex) {
+	if node.Spec.BGP == nil || node.Spec.BGP.IPv4Address == "" {
+		getLogger(ctx, "").Warn("Node subnet is not known, not preferring a pool in the node's subnet")
+		addRunWarning(ctx, "node subnet is not known, not preferring a pool in the node's subnet")
+		return
+	}
+	_, subnet, err := net.ParseCIDR(node.Spec.BGP.IPv4Address)
+	if err != nil {
+		getLogger(ctx, "").WithError(err).Warn("Failed to parse the node's IPv4 address, not preferring a pool in the node's subnet")
+		addRunWarning(ctx, "failed to parse the node's IPv4 address %s", node.Spec.BGP.IPv4Address)
+		return
+	}
+
+	for attrType, cidrs := range idx {
+		logCtx := getLogger(ctx, attrType).WithField("subnet", subnet.String())
+		var best *net.IPNet
+		for i := range cidrs {
+			cidr := cidrs[i]
+			if !cidr.Contains(subnet.IP) && !subnet.Contains(cidr.IP) {
+				continue
+			}
+			if best == nil || morePreferredPool(cidr, *best) {
+				best = &cidr
+			}
+		}
+		if best == nil {
+			logCtx.Warn("No tunnel address pool overlaps the node's subnet, using any eligible pool")
+			addRunWarning(ctx, "%s: no tunnel address pool overlaps the node's subnet %s", attrType, subnet)
+			continue
+		}
+		logCtx.WithField("pool", best.String()).Debug("Using the tunnel address pool in the node's subnet")
+		idx[attrType] = []net.IPNet{*best}
+	}
+}
+
+// morePreferredPool returns whether pool a is preferred to pool b when both overlap the node's subnet: the pool with
+// the longer prefix, or else the one with the lower address.
+func morePreferredPool(a, b net.IPNet) bool {
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	if aOnes != bOnes {
+		return aOnes > bOnes
+	}
+	return bytes.Compare(a.IP.To16(), b.IP.To16()) < 0
+}
@@ -11,17 +11,27 @@ import (
 // CreateClient loads the client config from environments and creates the
 // Calico client.
 func CreateClient() (*apiconfig.CalicoAPIConfig, client.Interface) {
-	// Load the client config from environment.
+	cfg := LoadConfig()
+	return cfg, CreateClientFromConfig(cfg)
+}
+
+// LoadConfig loads the client config from environments. This allows the
+// config to be adjusted before creating the client with CreateClientFromConfig.
+func LoadConfig() *apiconfig.CalicoAPIConfig {
 	cfg, err := apiconfig.LoadClientConfig("")
 	if err != nil {
 		fmt.Printf("ERROR: Error loading datastore config: %s", err)
 		os.Exit(1)
 	}
+	return cfg
+}
+
+// CreateClientFromConfig creates the Calico client from the supplied config.
+func CreateClientFromConfig(cfg *apiconfig.CalicoAPIConfig) client.Interface {
 	c, err := client.New(*cfg)
 	if err != nil {
 		fmt.Printf("ERROR: Error accessing the Calico datastore: %s", err)
 		os.Exit(1)
 	}
-
-	return cfg, c
+	return c
 }